@@ -3,6 +3,7 @@ package backend
 import (
 	"errors"
 	"io"
+	"log"
 	"os"
 
 	"github.com/lebauce/vlaunch/config"
@@ -16,6 +17,27 @@ type USBDevice struct {
 	Device     string
 }
 
+// Partition describes a partition of a device
+type Partition struct {
+	Device      string   `json:"device"`
+	Size        uint64   `json:"size"`
+	Filesystem  string   `json:"filesystem,omitempty"`
+	Label       string   `json:"label,omitempty"`
+	UUID        string   `json:"uuid,omitempty"`
+	Mountpoints []string `json:"mountpoints,omitempty"`
+}
+
+// Device describes a removable device vlaunch could start from
+type Device struct {
+	Device     string      `json:"device"`
+	Vendor     string      `json:"vendor,omitempty"`
+	Model      string      `json:"model,omitempty"`
+	Serial     string      `json:"serial,omitempty"`
+	USBID      string      `json:"usb_id,omitempty"`
+	Size       uint64      `json:"size"`
+	Partitions []Partition `json:"partitions"`
+}
+
 type DeviceFile interface {
 	io.Reader
 	io.Writer
@@ -23,11 +45,39 @@ type DeviceFile interface {
 	io.Closer
 }
 
+// FindDevice returns the device to start from. It is, by order of
+// precedence, the configured device, the one matching the device_match
+// section, the one holding the filesystem with the configured UUID, and
+// the one the executable is stored on. No other device is tried when
+// device_match is set. Disks the host system depends on are refused.
 func FindDevice() (string, error) {
+	device, err := findDevice()
+	if err != nil {
+		return "", err
+	}
+
+	if err := CheckDevice(device); err != nil {
+		return "", err
+	}
+
+	return device, nil
+}
+
+func findDevice() (string, error) {
 	if device := config.GetConfig().GetString("device"); device != "" {
 		return device, nil
 	}
 
+	// Falling back to another device would start the wrong system
+	if match := deviceMatch(); len(match) > 0 {
+		device, err := MatchDevice(match)
+		if err != nil {
+			log.Printf("No device matches device_match: %s\n", err.Error())
+			return "", DeviceNotFound
+		}
+		return device, nil
+	}
+
 	if uuid := config.GetConfig().GetString("device_uuid"); uuid != "" {
 		if device, err := FindDeviceByUUID(uuid); err == nil {
 			return device, nil
@@ -0,0 +1,121 @@
+package backend
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ProbeSize is the amount of data to read at the start of a partition to
+// detect its filesystem, enough to reach the btrfs superblock
+const ProbeSize = 72 * 1024
+
+type signature struct {
+	Name   string
+	Offset int
+	Magic  string
+}
+
+// filesystemSignatures are the magic numbers of the superblocks
+var filesystemSignatures = []signature{
+	{"ntfs", 3, "NTFS    "},
+	{"exfat", 3, "EXFAT   "},
+	{"fat", 54, "FAT12   "},
+	{"fat", 54, "FAT16   "},
+	{"fat", 82, "FAT32   "},
+	{"ext", 1080, "\x53\xef"},
+	{"btrfs", 65600, "_BHRfS_M"},
+	{"hfsplus", 1024, "H+"},
+	{"hfsplus", 1024, "HX"},
+	{"apfs", 32, "NXSB"},
+}
+
+// DetectFilesystem returns the type of the filesystem starting with data,
+// or an empty string if it is unknown
+func DetectFilesystem(data []byte) string {
+	for _, sig := range filesystemSignatures {
+		end := sig.Offset + len(sig.Magic)
+		if end <= len(data) && string(data[sig.Offset:end]) == sig.Magic {
+			return sig.Name
+		}
+	}
+	return ""
+}
+
+// FilesystemUUID returns the UUID or serial number of the filesystem
+// starting with data, formatted like blkid does
+func FilesystemUUID(data []byte, filesystem string) string {
+	switch filesystem {
+	case "fat":
+		// FAT32 has a larger BIOS parameter block
+		offset := 39
+		if string(data[82:90]) == "FAT32   " {
+			offset = 67
+		}
+		serial := binary.LittleEndian.Uint32(data[offset:])
+		return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+	case "exfat":
+		serial := binary.LittleEndian.Uint32(data[100:])
+		return fmt.Sprintf("%04X-%04X", serial>>16, serial&0xffff)
+	case "ntfs":
+		return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(data[72:]))
+	case "ext", "btrfs":
+		offset := 1128
+		if filesystem == "btrfs" {
+			offset = 65536 + 32
+		}
+		id := data[offset : offset+16]
+		return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+	}
+	return ""
+}
+
+// FilesystemLabel returns the label of the filesystem starting with data,
+// if it is stored in the superblock
+func FilesystemLabel(data []byte, filesystem string) string {
+	var label []byte
+	switch filesystem {
+	case "fat":
+		label = data[43:54]
+		if string(data[82:90]) == "FAT32   " {
+			label = data[71:82]
+		}
+		if string(label) == "NO NAME    " {
+			return ""
+		}
+	case "ext":
+		label = data[1144:1160]
+	case "btrfs":
+		label = data[65536+299 : 65536+299+256]
+	}
+	return strings.TrimRight(string(label), " \x00")
+}
+
+// probeFilesystem returns the type, label and UUID of the filesystem of
+// the partition
+func probeFilesystem(partition string) (filesystem, label, uuid string, err error) {
+	dev, err := OpenDevice(partition, os.O_RDONLY)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer dev.Close()
+
+	data := make([]byte, ProbeSize)
+	if _, err := io.ReadFull(dev, data); err != nil {
+		return "", "", "", err
+	}
+
+	if filesystem = DetectFilesystem(data); filesystem == "" {
+		return "", "", "", fmt.Errorf("No known filesystem found on %s", partition)
+	}
+
+	return filesystem, FilesystemLabel(data, filesystem), FilesystemUUID(data, filesystem), nil
+}
+
+// ReadFilesystemUUID returns the UUID of the filesystem of the partition
+func ReadFilesystemUUID(partition string) (string, error) {
+	_, _, uuid, err := probeFilesystem(partition)
+	return uuid, err
+}
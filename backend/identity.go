@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lebauce/vlaunch/config"
+	"github.com/rekby/gpt"
+)
+
+// deviceMatchKeys are the keys of the device_match section, by order of
+// precedence. The most stable identifiers come first.
+var deviceMatchKeys = []string{"serial", "disk_guid", "partuuid", "partlabel", "usb_id", "label"}
+
+// diskIdentity holds the identifiers stored in the partition table
+type diskIdentity struct {
+	DiskGUID   string
+	PartUUIDs  []string
+	PartLabels []string
+	// Starts maps the first sector of each partition to its number
+	Starts map[uint64]int
+}
+
+// readDiskIdentity reads the identifiers of the partition table of the
+// device
+func readDiskIdentity(device string) (*diskIdentity, error) {
+	sectorSize, _, err := GetSectorSize(device)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := OpenDevice(device, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+
+	identity, err := parseDiskIdentity(dev, sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the partition table of %s: %s", device, err.Error())
+	}
+	return identity, nil
+}
+
+// parseDiskIdentity reads the identifiers of the partition table of the
+// disk. MBR partitions are given a PARTUUID made of the disk signature and
+// the partition number in hexadecimal, as Linux does. Logical partitions
+// are numbered from 5.
+func parseDiskIdentity(r io.ReadSeeker, sectorSize uint64) (*diskIdentity, error) {
+	head := make([]byte, 32768)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	identity := &diskIdentity{Starts: make(map[uint64]int)}
+	headReader := bytes.NewReader(head)
+	headReader.Seek(int64(sectorSize), io.SeekStart)
+	if table, err := gpt.ReadTable(headReader, sectorSize); err == nil {
+		identity.DiskGUID = table.Header.DiskGUID.String()
+		for i, part := range table.Partitions {
+			if !part.IsEmpty() {
+				identity.Starts[part.FirstLBA] = i + 1
+				identity.PartUUIDs = append(identity.PartUUIDs, part.Id.String())
+				identity.PartLabels = append(identity.PartLabels, strings.TrimRight(part.Name(), "\x00"))
+			}
+		}
+		return identity, nil
+	}
+
+	if head[510] != 0x55 || head[511] != 0xaa {
+		return nil, errors.New("No partition table found")
+	}
+
+	signature := binary.LittleEndian.Uint32(head[440:444])
+	partUUID := func(number int) string {
+		return fmt.Sprintf("%08x-%02x", signature, number)
+	}
+
+	var extendedFirst, extendedLast uint64
+	for i := 0; i < 4; i++ {
+		entry := head[446+16*i:]
+		if entry[4] == 0 {
+			continue
+		}
+
+		first := uint64(binary.LittleEndian.Uint32(entry[8:12]))
+		if count := uint64(binary.LittleEndian.Uint32(entry[12:16])); IsExtendedPartition(entry[4]) {
+			if count != 0 {
+				extendedFirst, extendedLast = first, first+count-1
+			}
+		} else {
+			identity.Starts[first] = i + 1
+		}
+		identity.PartUUIDs = append(identity.PartUUIDs, partUUID(i+1))
+	}
+
+	if extendedFirst != 0 {
+		logicals, err := ReadLogicalPartitions(r, sectorSize, extendedFirst, extendedLast)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, part := range logicals {
+			identity.Starts[part.FirstLBA] = part.Index
+			identity.PartUUIDs = append(identity.PartUUIDs, partUUID(part.Index))
+		}
+	}
+
+	return identity, nil
+}
+
+// deviceIdentifiers returns the identifiers of the device for the key of
+// the device_match section
+func deviceIdentifiers(device Device, key string) []string {
+	switch key {
+	case "serial":
+		return []string{device.Serial}
+	case "usb_id":
+		return []string{device.USBID}
+	case "label":
+		var labels []string
+		for _, part := range device.Partitions {
+			labels = append(labels, part.Label)
+		}
+		return labels
+	}
+
+	identity, err := readDiskIdentity(device.Device)
+	if err != nil {
+		return nil
+	}
+
+	switch key {
+	case "disk_guid":
+		return []string{identity.DiskGUID}
+	case "partuuid":
+		return identity.PartUUIDs
+	default:
+		return identity.PartLabels
+	}
+}
+
+// MatchDevice returns the device matching the criteria of the device_match
+// section. The keys are tried by order of precedence, and the first one
+// designating a single device wins.
+func MatchDevice(match map[string]string) (string, error) {
+	for key := range match {
+		known := false
+		for _, matchKey := range deviceMatchKeys {
+			known = known || key == matchKey
+		}
+		if !known {
+			log.Printf("Ignoring unknown device_match key '%s'\n", key)
+		}
+	}
+
+	devices, err := ListDevices()
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range deviceMatchKeys {
+		value, found := match[key]
+		if !found || value == "" {
+			continue
+		}
+
+		var matching []string
+		for _, device := range devices {
+			for _, identifier := range deviceIdentifiers(device, key) {
+				if identifier != "" && strings.EqualFold(identifier, value) {
+					matching = append(matching, device.Device)
+					break
+				}
+			}
+		}
+
+		switch len(matching) {
+		case 0:
+		case 1:
+			log.Printf("Found device %s by %s\n", matching[0], key)
+			return matching[0], nil
+		default:
+			log.Printf("Several devices match %s '%s': %s\n", key, value, strings.Join(matching, ", "))
+		}
+	}
+
+	return "", DeviceNotFound
+}
+
+// deviceMatch returns the device_match section of the configuration
+func deviceMatch() map[string]string {
+	return config.GetConfig().GetStringMapString("device_match")
+}
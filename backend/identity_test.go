@@ -0,0 +1,92 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// putPartition writes an MBR partition entry in the table of the sector
+func putPartition(sector []byte, slot int, partType byte, first, count uint32) {
+	entry := sector[446+16*slot:]
+	entry[4] = partType
+	binary.LittleEndian.PutUint32(entry[8:], first)
+	binary.LittleEndian.PutUint32(entry[12:], count)
+	sector[510], sector[511] = 0x55, 0xaa
+}
+
+func TestParseDiskIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		build     func(disk []byte)
+		partUUIDs []string
+		starts    map[uint64]int
+		fails     bool
+	}{
+		{
+			name: "primary partitions",
+			build: func(disk []byte) {
+				putPartition(disk, 0, 0x83, 2048, 2048)
+				putPartition(disk, 2, 0x07, 4096, 2048)
+			},
+			partUUIDs: []string{"deadbeef-01", "deadbeef-03"},
+			starts:    map[uint64]int{2048: 1, 4096: 3},
+		},
+		{
+			name: "logical partitions",
+			build: func(disk []byte) {
+				putPartition(disk, 0, 0x83, 2048, 2048)
+				putPartition(disk, 1, 0x05, 4096, 8192)
+				// The first EBR links to the second one, 2048 sectors
+				// after the start of the extended partition
+				putPartition(disk[4096*512:], 0, 0x83, 1, 1000)
+				putPartition(disk[4096*512:], 1, 0x05, 2048, 2000)
+				putPartition(disk[6144*512:], 0, 0x07, 1, 1000)
+			},
+			partUUIDs: []string{"deadbeef-01", "deadbeef-02", "deadbeef-05", "deadbeef-06"},
+			starts:    map[uint64]int{2048: 1, 4097: 5, 6145: 6},
+		},
+		{
+			name: "empty extended partition",
+			build: func(disk []byte) {
+				putPartition(disk, 0, 0x0f, 2048, 8192)
+				disk[2048*512+510], disk[2048*512+511] = 0x55, 0xaa
+			},
+			partUUIDs: []string{"deadbeef-01"},
+			starts:    map[uint64]int{},
+		},
+		{
+			name: "EBR chain going backwards",
+			build: func(disk []byte) {
+				putPartition(disk, 0, 0x05, 4096, 8192)
+				putPartition(disk[4096*512:], 0, 0x83, 1, 1000)
+				putPartition(disk[4096*512:], 1, 0x05, 0, 2000)
+			},
+			fails: true,
+		},
+		{
+			name:  "no partition table",
+			build: func(disk []byte) {},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		disk := make([]byte, 12288*512)
+		test.build(disk)
+		binary.LittleEndian.PutUint32(disk[440:], 0xdeadbeef)
+
+		identity, err := parseDiskIdentity(bytes.NewReader(disk), 512)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s: expected an error, got %+v", test.name, identity)
+		case !test.fails && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		case !test.fails && !reflect.DeepEqual(identity.PartUUIDs, test.partUUIDs):
+			t.Errorf("%s: expected %v, got %v", test.name, test.partUUIDs, identity.PartUUIDs)
+		case !test.fails && !reflect.DeepEqual(identity.Starts, test.starts):
+			t.Errorf("%s: expected starts %v, got %v", test.name, test.starts, identity.Starts)
+		}
+	}
+}
@@ -13,7 +13,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"unicode"
+	"syscall"
 
 	"github.com/guillermo/go.procmeminfo"
 )
@@ -34,38 +34,704 @@ func GetFreeRam() (uint64, error) {
 }
 
 func GetDeviceSize(device string) (uint64, error) {
-	content, err := ioutil.ReadFile(fmt.Sprintf("/sys/block/%s/size", path.Base(device)))
+	// /sys/class/block holds both the disks and their partitions
+	content, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/block/%s/size", path.Base(device)))
 	if err != nil {
 		return 0, err
 	}
 
+	// The size is always expressed in 512 bytes units, whatever the
+	// logical block size of the device
 	size, err := strconv.Atoi(strings.TrimSpace(string(content)))
 	return uint64(size) * 512, err
 }
 
+// GetSectorSize returns the logical and physical sector sizes of the device
+func GetSectorSize(device string) (logical uint64, physical uint64, err error) {
+	readSize := func(name string) (uint64, error) {
+		content, err := ioutil.ReadFile(fmt.Sprintf("/sys/block/%s/queue/%s", path.Base(device), name))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+	}
+
+	if logical, err = readSize("logical_block_size"); err != nil {
+		return 0, 0, err
+	}
+
+	if physical, err = readSize("physical_block_size"); err != nil {
+		return 0, 0, err
+	}
+
+	return logical, physical, nil
+}
+
+// GetPartitionDevices returns the device nodes of the partitions of the
+// device, indexed by their start sector in units of 512 bytes
+func GetPartitionDevices(device string) (map[uint64]string, error) {
+	sysPath := fmt.Sprintf("/sys/block/%s", path.Base(device))
+	entries, err := ioutil.ReadDir(sysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	partitions := make(map[uint64]string)
+	for _, entry := range entries {
+		partPath := path.Join(sysPath, entry.Name())
+		if _, err := os.Stat(path.Join(partPath, "partition")); err != nil {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path.Join(partPath, "start"))
+		if err != nil {
+			return nil, err
+		}
+
+		start, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid start sector for %s: %s", entry.Name(), err.Error())
+		}
+
+		partitions[start] = path.Join("/dev", entry.Name())
+	}
+
+	return partitions, nil
+}
+
+// getUSBID returns the vendor and product IDs of the USB device the
+// device belongs to, as vendor:product
+func getUSBID(device string) (string, error) {
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/block/%s/device", path.Base(device)))
+	if err != nil {
+		return "", err
+	}
+
+	for dir := sysPath; strings.HasPrefix(dir, "/sys/devices/"); dir = path.Dir(dir) {
+		vendor := readSysfsString(path.Join(dir, "idVendor"))
+		product := readSysfsString(path.Join(dir, "idProduct"))
+		if vendor != "" && product != "" {
+			return vendor + ":" + product, nil
+		}
+	}
+
+	return "", fmt.Errorf("%s is not a USB device", device)
+}
+
+// GetDeviceSerial returns the serial number of the device, as reported by
+// the device itself or the USB device it belongs to
+func GetDeviceSerial(device string) (string, error) {
+	sysPath, err := filepath.EvalSymlinks(fmt.Sprintf("/sys/block/%s/device", path.Base(device)))
+	if err != nil {
+		return "", err
+	}
+
+	for dir := sysPath; strings.HasPrefix(dir, "/sys/devices/"); dir = path.Dir(dir) {
+		if content, err := ioutil.ReadFile(path.Join(dir, "serial")); err == nil {
+			if serial := strings.TrimSpace(string(content)); serial != "" {
+				return serial, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("No serial number found for %s", device)
+}
+
+// IsRemovable returns whether the device is removable or attached through USB
+func IsRemovable(device string) (bool, error) {
+	sysPath := fmt.Sprintf("/sys/block/%s", path.Base(device))
+	content, err := ioutil.ReadFile(path.Join(sysPath, "removable"))
+	if err != nil {
+		return false, err
+	}
+
+	if strings.TrimSpace(string(content)) == "1" {
+		return true, nil
+	}
+
+	// USB disks are often not flagged as removable
+	devicePath, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(devicePath, "/usb"), nil
+}
+
+// ReloadPartitions asks the kernel to read the partition table again
+func ReloadPartitions(device string) error {
+	file, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// BLKRRPART
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), 0x125f, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// InvalidateCache writes the dirty blocks of the device and drops its
+// cached ones, so that the next reads come from the media
+func InvalidateCache(device string) error {
+	file, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// BLKFLSBUF
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, file.Fd(), 0x1261, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// MountPartition mounts the partition, holding a filesystem as named by
+// the vmdk package, on a temporary directory and returns it
+func MountPartition(partition string, filesystem string) (string, error) {
+	fsTypes := map[string][]string{
+		"fat":   {"vfat"},
+		"exfat": {"exfat"},
+		"ntfs":  {"ntfs3", "ntfs"},
+		"ext":   {"ext4"},
+	}[filesystem]
+	if len(fsTypes) == 0 {
+		return "", fmt.Errorf("Unsupported filesystem '%s'", filesystem)
+	}
+
+	mountpoint, err := ioutil.TempDir("", "vlaunch")
+	if err != nil {
+		return "", err
+	}
+
+	for _, fsType := range fsTypes {
+		if err = syscall.Mount(partition, mountpoint, fsType, 0, ""); err == nil {
+			return mountpoint, nil
+		}
+	}
+
+	os.Remove(mountpoint)
+	return "", fmt.Errorf("Failed to mount %s: %s", partition, err.Error())
+}
+
+// UnmountPartition unmounts the partition mounted by MountPartition
+func UnmountPartition(mountpoint string) error {
+	if err := syscall.Unmount(mountpoint, 0); err != nil {
+		return err
+	}
+	return os.Remove(mountpoint)
+}
+
+// parentDisk returns the device node of the disk holding the block device
+// named name, which is either a partition or a whole disk
+func parentDisk(name string) (string, error) {
+	sysPath, err := filepath.EvalSymlinks(path.Join("/sys/class/block", name))
+	if err != nil {
+		return "", err
+	}
+
+	// Partitions are subdirectories of their disk
+	if _, err := os.Stat(path.Join(sysPath, "partition")); err == nil {
+		sysPath = path.Dir(sysPath)
+	}
+
+	return path.Join("/dev", path.Base(sysPath)), nil
+}
+
+// PartitionDisk returns the disk holding the partition
+func PartitionDisk(partition string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(partition)
+	if err != nil {
+		return "", err
+	}
+	return parentDisk(path.Base(resolved))
+}
+
+// FindDeviceByUUID returns the disk holding the filesystem with the given
+// UUID. Disks without partition table are also looked at.
 func FindDeviceByUUID(uuid string) (string, error) {
-	matches, err := filepath.Glob("/dev/sd?[0-9]")
+	entries, err := ioutil.ReadDir("/sys/class/block")
 	if err != nil {
 		return "", err
 	}
 
-	for _, device := range matches {
-		output, _ := exec.Command("/usr/sbin/blkid", "-o", "value", "-s", "UUID", "-c", "/dev/null", device).Output()
-		if strings.TrimSpace(string(output)) == uuid {
-			return strings.TrimRightFunc(device, unicode.IsDigit), nil
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, "ram") || strings.HasPrefix(name, "zram") {
+			continue
 		}
+
+		fsUUID, err := ReadFilesystemUUID(path.Join("/dev", name))
+		if err != nil || !strings.EqualFold(fsUUID, uuid) {
+			continue
+		}
+
+		return parentDisk(name)
 	}
 
 	return "", DeviceNotFound
 }
 
-func FindDeviceByPath(path string) (string, error) {
-	output, _ := exec.Command("/usr/bin/findmnt", "-v", "-n", "-o", "SOURCE", "--target", path).Output()
-	if device := strings.TrimSpace(string(output)); device != "" {
-		return strings.TrimRightFunc(device, unicode.IsDigit), nil
+// unescapeMountinfo decodes the octal escapes of the paths of mountinfo
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
 	}
+	return b.String()
+}
 
-	return "", DeviceNotFound
+// mount is an entry of /proc/self/mountinfo
+type mount struct {
+	DevNumber    string
+	Root         string
+	Mountpoint   string
+	Options      string
+	Filesystem   string
+	Source       string
+	SuperOptions string
+}
+
+func readMountinfo() ([]mount, error) {
+	content, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	var mounts []mount
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+
+		m := mount{
+			DevNumber:  fields[2],
+			Root:       unescapeMountinfo(fields[3]),
+			Mountpoint: unescapeMountinfo(fields[4]),
+			Options:    fields[5],
+		}
+
+		// Optional fields are ended by a single dash
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" && i+3 < len(fields) {
+				m.Filesystem = fields[i+1]
+				m.Source = unescapeMountinfo(fields[i+2])
+				m.SuperOptions = fields[i+3]
+				break
+			}
+		}
+
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// FindDeviceByPath returns the disk holding the filesystem the file at
+// path is stored on
+func FindDeviceByPath(filePath string) (string, error) {
+	if resolved, err := filepath.EvalSymlinks(filePath); err == nil {
+		filePath = resolved
+	}
+
+	mounts, err := readMountinfo()
+	if err != nil {
+		return "", err
+	}
+
+	// Look for the deepest mount point containing the file
+	var mountpoint, devNumber string
+	for _, m := range mounts {
+		if m.Mountpoint != "/" && filePath != m.Mountpoint && !strings.HasPrefix(filePath, m.Mountpoint+"/") {
+			continue
+		}
+
+		if len(m.Mountpoint) >= len(mountpoint) {
+			mountpoint, devNumber = m.Mountpoint, m.DevNumber
+		}
+	}
+
+	if devNumber == "" {
+		return "", DeviceNotFound
+	}
+
+	// Filesystems without a block device, such as tmpfs, are not found
+	sysPath, err := filepath.EvalSymlinks(path.Join("/sys/dev/block", devNumber))
+	if err != nil {
+		return "", DeviceNotFound
+	}
+
+	return parentDisk(path.Base(sysPath))
+}
+
+// systemMountpoints are the mount points the host cannot run without
+var systemMountpoints = []string{"/", "/boot", "/boot/efi", "/usr"}
+
+// underlyingDisks returns the disks holding the block device, following
+// the slaves of device mapper and MD devices
+func underlyingDisks(name string) []string {
+	slaves, _ := ioutil.ReadDir(path.Join("/sys/class/block", name, "slaves"))
+	if len(slaves) == 0 {
+		disk, err := parentDisk(name)
+		if err != nil {
+			return nil
+		}
+		return []string{path.Base(disk)}
+	}
+
+	var disks []string
+	for _, slave := range slaves {
+		disks = append(disks, underlyingDisks(slave.Name())...)
+	}
+	return disks
+}
+
+// holderName returns a readable name for a block device holding another
+// one, such as the name of a LVM logical volume
+func holderName(name string) string {
+	if dmName := readSysfsString(path.Join("/sys/class/block", name, "dm", "name")); dmName != "" {
+		return dmName
+	}
+	return name
+}
+
+// ClassifyDevice tells how the device is attached and lists what the host
+// uses it for: system mount points, swap, and LVM, MD or dm-crypt volumes
+// built on top of it
+func ClassifyDevice(device string) (*DeviceClass, error) {
+	name := path.Base(device)
+	sysPath, err := filepath.EvalSymlinks(path.Join("/sys/block", name))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a disk", device)
+	}
+
+	class := &DeviceClass{
+		Removable: readSysfsString(path.Join(sysPath, "removable")) == "1",
+		USB:       strings.Contains(sysPath, "/usb"),
+	}
+
+	usedBy := func(block string, reason string) {
+		for _, disk := range underlyingDisks(block) {
+			if disk == name {
+				class.System = append(class.System, reason)
+				return
+			}
+		}
+	}
+
+	mounts, err := readMountinfo()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range mounts {
+		for _, mountpoint := range systemMountpoints {
+			if m.Mountpoint != mountpoint {
+				continue
+			}
+			if blockPath, err := filepath.EvalSymlinks(path.Join("/sys/dev/block", m.DevNumber)); err == nil {
+				usedBy(path.Base(blockPath), "holds "+mountpoint)
+			}
+		}
+	}
+
+	if content, err := ioutil.ReadFile("/proc/swaps"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[1] == "partition" {
+				if swapPath, err := filepath.EvalSymlinks(unescapeMountinfo(fields[0])); err == nil {
+					usedBy(path.Base(swapPath), "holds swap")
+				}
+			}
+		}
+	}
+
+	// Active LVM physical volumes, MD members and opened dm-crypt volumes
+	// have holders
+	blocks := []string{name}
+	if entries, err := ioutil.ReadDir(sysPath); err == nil {
+		for _, entry := range entries {
+			if _, err := os.Stat(path.Join(sysPath, entry.Name(), "partition")); err == nil {
+				blocks = append(blocks, entry.Name())
+			}
+		}
+	}
+
+	for _, block := range blocks {
+		holders, _ := ioutil.ReadDir(path.Join("/sys/class/block", block, "holders"))
+		for _, holder := range holders {
+			class.System = append(class.System, fmt.Sprintf("%s is used by %s", block, holderName(holder.Name())))
+		}
+	}
+
+	return class, nil
+}
+
+// DeviceMounts returns the mounts of the partitions of the device, in the
+// order they were mounted
+func DeviceMounts(device string) ([]MountedPartition, error) {
+	mounts, err := readMountinfo()
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []MountedPartition
+	for _, m := range mounts {
+		sysPath, err := filepath.EvalSymlinks(path.Join("/sys/dev/block", m.DevNumber))
+		if err != nil {
+			continue
+		}
+
+		if disk, err := parentDisk(path.Base(sysPath)); err != nil || path.Base(disk) != path.Base(device) {
+			continue
+		}
+
+		index, _ := strconv.Atoi(readSysfsString(path.Join(sysPath, "partition")))
+		partitions = append(partitions, MountedPartition{
+			Partition:    path.Join("/dev", path.Base(sysPath)),
+			Index:        index,
+			Mountpoint:   m.Mountpoint,
+			Filesystem:   m.Filesystem,
+			Options:      m.Options,
+			root:         m.Root,
+			superOptions: m.SuperOptions,
+		})
+	}
+
+	return partitions, nil
+}
+
+// flags returns the mount flags matching the options of the mount point
+func (m MountedPartition) flags() uintptr {
+	known := map[string]uintptr{
+		"ro":         syscall.MS_RDONLY,
+		"nosuid":     syscall.MS_NOSUID,
+		"nodev":      syscall.MS_NODEV,
+		"noexec":     syscall.MS_NOEXEC,
+		"sync":       syscall.MS_SYNCHRONOUS,
+		"noatime":    syscall.MS_NOATIME,
+		"nodiratime": syscall.MS_NODIRATIME,
+		"relatime":   syscall.MS_RELATIME,
+	}
+
+	var flags uintptr
+	for _, option := range strings.Split(m.Options, ",") {
+		flags |= known[option]
+	}
+	return flags
+}
+
+// data returns the filesystem specific options of the mount point
+func (m MountedPartition) data() string {
+	var options []string
+	for _, option := range strings.Split(m.superOptions, ",") {
+		switch option {
+		case "rw", "ro", "seclabel":
+		default:
+			options = append(options, option)
+		}
+	}
+	return strings.Join(options, ",")
+}
+
+// LockPartitions flushes and unmounts the partitions, then opens them
+// exclusively so that the host cannot mount them again. It fails if one
+// of them is busy, after mounting back the ones already unmounted.
+func LockPartitions(mounts []MountedPartition) (*PartitionLock, error) {
+	syscall.Sync()
+
+	lock := &PartitionLock{}
+
+	// Submounts come after their parent, unmount them first
+	for i := len(mounts) - 1; i >= 0; i-- {
+		m := mounts[i]
+		log.Printf("Unmounting %s from %s\n", m.Partition, m.Mountpoint)
+		if err := syscall.Unmount(m.Mountpoint, 0); err != nil {
+			lock.Restore()
+			return nil, fmt.Errorf("Failed to unmount %s from %s, it may be in use: %s", m.Partition, m.Mountpoint, err.Error())
+		}
+		lock.unmounted = append(lock.unmounted, m)
+	}
+
+	locked := make(map[string]bool)
+	for _, m := range lock.unmounted {
+		if locked[m.Partition] {
+			continue
+		}
+		locked[m.Partition] = true
+
+		file, err := os.OpenFile(m.Partition, os.O_RDONLY|syscall.O_EXCL, 0)
+		if err != nil {
+			log.Printf("Failed to lock %s: %s\n", m.Partition, err.Error())
+			continue
+		}
+		lock.files = append(lock.files, file)
+	}
+
+	return lock, nil
+}
+
+// mountAgain mounts the partition back where it was. Additional mounts of
+// a partition are bind mounts of its first one.
+func mountAgain(m MountedPartition, mounted map[string]string) error {
+	if err := os.MkdirAll(m.Mountpoint, 0755); err != nil {
+		return err
+	}
+
+	if source, found := mounted[m.Partition]; found {
+		return syscall.Mount(path.Join(source, m.root), m.Mountpoint, "", syscall.MS_BIND, "")
+	}
+
+	if m.root != "/" {
+		return fmt.Errorf("Only a subdirectory of %s was mounted", m.Partition)
+	}
+
+	if err := syscall.Mount(m.Partition, m.Mountpoint, m.Filesystem, m.flags(), m.data()); err != nil {
+		// Filesystems such as FUSE ones need their mount helper
+		output, err := exec.Command("mount", "-o", m.Options, m.Partition, m.Mountpoint).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+		}
+	}
+
+	mounted[m.Partition] = m.Mountpoint
+	return nil
+}
+
+// Restore releases the exclusive opens and mounts the partitions back as
+// they were before LockPartitions
+func (lock *PartitionLock) Restore() error {
+	for _, file := range lock.files {
+		file.Close()
+	}
+
+	var errs []string
+
+	// Mount parents first, they were unmounted last
+	mounted := make(map[string]string)
+	for i := len(lock.unmounted) - 1; i >= 0; i-- {
+		m := lock.unmounted[i]
+		log.Printf("Mounting %s on %s\n", m.Partition, m.Mountpoint)
+		if err := mountAgain(m, mounted); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", m.Mountpoint, err.Error()))
+		}
+	}
+
+	lock.files, lock.unmounted = nil, nil
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to restore mounts: %s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// readSysfsString returns the trimmed content of a sysfs attribute, or an
+// empty string if it does not exist
+func readSysfsString(sysPath string) string {
+	content, err := ioutil.ReadFile(sysPath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// ListDevices returns the removable and USB devices
+func ListDevices() ([]Device, error) {
+	entries, err := ioutil.ReadDir("/sys/block")
+	if err != nil {
+		return nil, err
+	}
+
+	mounts, err := readMountinfo()
+	if err != nil {
+		return nil, err
+	}
+
+	mountpoints := func(sysPath string) (result []string) {
+		devNumber := readSysfsString(path.Join(sysPath, "dev"))
+		for _, m := range mounts {
+			if m.DevNumber == devNumber {
+				result = append(result, m.Mountpoint)
+			}
+		}
+		return result
+	}
+
+	var devices []Device
+	for _, entry := range entries {
+		name := entry.Name()
+		if removable, err := IsRemovable(name); err != nil || !removable {
+			continue
+		}
+
+		sysPath := path.Join("/sys/block", name)
+		size, err := GetDeviceSize(name)
+		if err != nil || size == 0 {
+			// Card readers without media
+			continue
+		}
+
+		device := Device{
+			Device: path.Join("/dev", name),
+			Vendor: readSysfsString(path.Join(sysPath, "device", "vendor")),
+			Model:  readSysfsString(path.Join(sysPath, "device", "model")),
+			Size:   size,
+		}
+
+		// MMC devices only have a name
+		if device.Model == "" {
+			device.Model = readSysfsString(path.Join(sysPath, "device", "name"))
+		}
+
+		device.Serial, _ = GetDeviceSerial(name)
+		device.USBID, _ = getUSBID(name)
+
+		partEntries, err := ioutil.ReadDir(sysPath)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, partEntry := range partEntries {
+			partPath := path.Join(sysPath, partEntry.Name())
+			if _, err := os.Stat(path.Join(partPath, "partition")); err != nil {
+				continue
+			}
+
+			partition := Partition{
+				Device:      path.Join("/dev", partEntry.Name()),
+				Mountpoints: mountpoints(partPath),
+			}
+			partition.Size, _ = GetDeviceSize(partEntry.Name())
+			partition.Filesystem, partition.Label, partition.UUID, _ = probeFilesystem(partition.Device)
+			device.Partitions = append(device.Partitions, partition)
+		}
+
+		// Superfloppies hold a filesystem without a partition table
+		if len(device.Partitions) == 0 {
+			if filesystem, label, uuid, err := probeFilesystem(device.Device); err == nil {
+				device.Partitions = append(device.Partitions, Partition{
+					Device:      device.Device,
+					Size:        size,
+					Filesystem:  filesystem,
+					Label:       label,
+					UUID:        uuid,
+					Mountpoints: mountpoints(sysPath),
+				})
+			}
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
 }
 
 func RunAsRoot(executable string, args ...string) error {
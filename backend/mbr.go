@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxLogicalPartitions bounds the walk of the EBR chain
+const MaxLogicalPartitions = 128
+
+// LogicalPartition is a partition described by an extended boot record
+type LogicalPartition struct {
+	// Index is the number of the partition, starting at 5
+	Index    int
+	EBRLBA   uint64
+	FirstLBA uint64
+	LastLBA  uint64
+	Type     byte
+	Bootable bool
+}
+
+// IsExtendedPartition returns whether the MBR partition type denotes an
+// extended partition container
+func IsExtendedPartition(partType byte) bool {
+	return partType == 0x05 || partType == 0x0f || partType == 0x85
+}
+
+// ReadLogicalPartitions walks the chain of extended boot records of the
+// extended partition spanning from first to last
+func ReadLogicalPartitions(r io.ReadSeeker, sectorSize, first, last uint64) ([]LogicalPartition, error) {
+	var parts []LogicalPartition
+
+	sector := make([]byte, sectorSize)
+	ebr := first
+	for index := 5; index < 5+MaxLogicalPartitions; index++ {
+		if _, err := r.Seek(int64(ebr*sectorSize), io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(r, sector); err != nil {
+			return nil, fmt.Errorf("Failed to read EBR at sector %d: %s", ebr, err.Error())
+		}
+
+		if sector[510] != 0x55 || sector[511] != 0xaa {
+			return nil, fmt.Errorf("Invalid EBR signature at sector %d", ebr)
+		}
+
+		// The first entry describes the logical partition, relatively to
+		// the EBR. The second one points to the next EBR, relatively to
+		// the start of the extended partition.
+		entry := sector[446:462]
+		next := sector[462:478]
+
+		if entry[4] != 0 {
+			start := ebr + uint64(binary.LittleEndian.Uint32(entry[8:12]))
+			count := uint64(binary.LittleEndian.Uint32(entry[12:16]))
+			if count == 0 || start+count-1 > last {
+				return nil, fmt.Errorf("Logical partition %d does not fit in the extended partition", index)
+			}
+
+			parts = append(parts, LogicalPartition{
+				Index:    index,
+				EBRLBA:   ebr,
+				FirstLBA: start,
+				LastLBA:  start + count - 1,
+				Type:     entry[4],
+				Bootable: entry[0] == 0x80,
+			})
+		}
+
+		if next[4] == 0 {
+			return parts, nil
+		}
+
+		nextEBR := first + uint64(binary.LittleEndian.Uint32(next[8:12]))
+		if nextEBR <= ebr || nextEBR > last {
+			return nil, fmt.Errorf("Invalid EBR chain at sector %d", ebr)
+		}
+		ebr = nextEBR
+	}
+
+	return nil, errors.New("Too many logical partitions")
+}
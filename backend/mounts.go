@@ -0,0 +1,36 @@
+package backend
+
+import (
+	"io"
+)
+
+// MountedPartition is a partition of a device mounted by the host
+type MountedPartition struct {
+	Partition string
+	// Index is the number of the partition on the device, or 0 for a
+	// filesystem spanning the whole device
+	Index      int
+	Mountpoint string
+	Filesystem string
+	Options    string
+
+	// root is the directory of the filesystem mounted, for bind mounts
+	root         string
+	superOptions string
+}
+
+// PartitionLock keeps the partitions of a device away from the host while
+// the guest uses them
+type PartitionLock struct {
+	unmounted []MountedPartition
+	files     []io.Closer
+}
+
+// Unlock releases the exclusive opens without mounting the partitions
+// back, for when their content was replaced
+func (lock *PartitionLock) Unlock() {
+	for _, file := range lock.files {
+		file.Close()
+	}
+	lock.files, lock.unmounted = nil, nil
+}
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lebauce/vlaunch/config"
+)
+
+// DeviceClass describes how a device is attached to the host and whether
+// the host depends on it
+type DeviceClass struct {
+	Removable bool
+	USB       bool
+	// System lists the reasons why the host depends on the device, such as
+	// holding its root filesystem or its swap
+	System []string
+}
+
+// CheckDevice refuses the devices the host system depends on, unless the
+// allow_system_disk option is set
+func CheckDevice(device string) error {
+	allowed := config.GetConfig().GetBool("allow_system_disk")
+
+	class, err := ClassifyDevice(device)
+	if err != nil {
+		if allowed {
+			log.Printf("Failed to classify device %s, using it as allowed by allow_system_disk: %s\n", device, err.Error())
+			return nil
+		}
+		return fmt.Errorf("Failed to classify device %s: %s", device, err.Error())
+	}
+
+	log.Printf("Device %s: removable %t, USB %t\n", device, class.Removable, class.USB)
+
+	if len(class.System) == 0 {
+		if !class.Removable && !class.USB {
+			log.Printf("%s is an internal disk but is not used by the host system\n", device)
+		}
+		return nil
+	}
+
+	reasons := strings.Join(class.System, ", ")
+	if allowed {
+		log.Printf("Using system disk %s as allowed by allow_system_disk: %s\n", device, reasons)
+		return nil
+	}
+
+	log.Printf("Refusing system disk %s: %s\n", device, reasons)
+	return fmt.Errorf("Refusing to use %s as it is a system disk (%s), set allow_system_disk to override", device, reasons)
+}
+
+// CheckPartition refuses the partitions of the devices the host system
+// depends on, as CheckDevice does
+func CheckPartition(partition string) error {
+	disk, err := PartitionDisk(partition)
+	if err != nil {
+		if config.GetConfig().GetBool("allow_system_disk") {
+			log.Printf("Failed to find the disk of %s, using it as allowed by allow_system_disk: %s\n", partition, err.Error())
+			return nil
+		}
+		return fmt.Errorf("Failed to find the disk of %s: %s", partition, err.Error())
+	}
+
+	return CheckDevice(disk)
+}
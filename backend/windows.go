@@ -37,8 +37,45 @@ type Win32_DiskPartition struct {
 }
 
 type Win32_DiskDrive struct {
-	DeviceID string
-	Name     string
+	DeviceID     string
+	Name         string
+	SerialNumber string
+}
+
+type win32DiskDriveMedia struct {
+	MediaType     string
+	InterfaceType string
+}
+
+type win32DiskDriveInfo struct {
+	DeviceID      string
+	Model         string
+	SerialNumber  string
+	InterfaceType string
+	MediaType     string
+	Size          uint64
+}
+
+type win32DiskPartitionInfo struct {
+	DeviceID       string
+	Index          uint32
+	Size           uint64
+	StartingOffset uint64
+}
+
+type win32OperatingSystem struct {
+	SystemDrive string
+}
+
+type win32PageFileUsage struct {
+	Name string
+}
+
+type win32LogicalDiskInfo struct {
+	DeviceID           string
+	FileSystem         string
+	VolumeName         string
+	VolumeSerialNumber string
 }
 
 type DiskGeometry struct {
@@ -84,6 +121,135 @@ func GetDeviceSize(device string) (uint64, error) {
 	return size, nil
 }
 
+func GetPartitionDevices(device string) (map[uint64]string, error) {
+	return nil, errors.New("Partition device nodes are not supported on Windows")
+}
+
+// GetSectorSize returns the logical and physical sector sizes of the device.
+// The physical sector size is assumed to be the logical one.
+func GetSectorSize(device string) (uint64, uint64, error) {
+	fd, err := windows.Open(device, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer windows.Close(fd)
+
+	var geometry DiskGeometry
+	var bytesReturned uint32
+	buffer := make([]byte, unsafe.Sizeof(geometry))
+	err = windows.DeviceIoControl(fd, C.IOCTL_DISK_GET_DRIVE_GEOMETRY, nil, 0, &buffer[0], uint32(len(buffer)), &bytesReturned, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := binary.Read(bytes.NewReader(buffer), binary.LittleEndian, &geometry); err != nil {
+		return 0, 0, err
+	}
+
+	return uint64(geometry.BytesPerSector), uint64(geometry.BytesPerSector), nil
+}
+
+// GetDeviceSerial returns the serial number of the device
+func GetDeviceSerial(device string) (string, error) {
+	var drives []Win32_DiskDrive
+	query := fmt.Sprintf("SELECT DeviceID, Name, SerialNumber FROM Win32_DiskDrive WHERE DeviceID = \"%s\"", strings.Replace(device, `\`, `\\`, -1))
+	if err := wmi.Query(query, &drives); err != nil {
+		return "", err
+	}
+
+	if len(drives) == 0 || strings.TrimSpace(drives[0].SerialNumber) == "" {
+		return "", fmt.Errorf("No serial number found for %s", device)
+	}
+
+	return strings.TrimSpace(drives[0].SerialNumber), nil
+}
+
+// IsRemovable returns whether the device is removable or attached through USB
+func IsRemovable(device string) (bool, error) {
+	var drives []win32DiskDriveMedia
+	query := fmt.Sprintf("SELECT MediaType, InterfaceType FROM Win32_DiskDrive WHERE DeviceID = \"%s\"", strings.Replace(device, `\`, `\\`, -1))
+	if err := wmi.Query(query, &drives); err != nil {
+		return false, err
+	}
+
+	if len(drives) == 0 {
+		return false, DeviceNotFound
+	}
+
+	return drives[0].InterfaceType == "USB" || strings.HasPrefix(drives[0].MediaType, "Removable"), nil
+}
+
+// ClassifyDevice tells how the device is attached and whether it holds the
+// Windows installation or a page file
+func ClassifyDevice(device string) (*DeviceClass, error) {
+	var drives []win32DiskDriveMedia
+	query := fmt.Sprintf("SELECT MediaType, InterfaceType FROM Win32_DiskDrive WHERE DeviceID = \"%s\"", strings.Replace(device, `\`, `\\`, -1))
+	if err := wmi.Query(query, &drives); err != nil {
+		return nil, err
+	}
+
+	if len(drives) == 0 {
+		return nil, DeviceNotFound
+	}
+
+	class := &DeviceClass{
+		Removable: strings.HasPrefix(drives[0].MediaType, "Removable"),
+		USB:       drives[0].InterfaceType == "USB",
+	}
+
+	usedBy := func(drive string, reason string) {
+		if disk, err := getDiskFromPartition(drive); err == nil && strings.EqualFold(disk, device) {
+			class.System = append(class.System, reason)
+		}
+	}
+
+	var systems []win32OperatingSystem
+	if err := wmi.Query("SELECT SystemDrive FROM Win32_OperatingSystem", &systems); err != nil {
+		return nil, err
+	}
+	for _, system := range systems {
+		usedBy(system.SystemDrive, "holds the system drive "+system.SystemDrive)
+	}
+
+	var pageFiles []win32PageFileUsage
+	if err := wmi.Query("SELECT Name FROM Win32_PageFileUsage", &pageFiles); err == nil {
+		for _, pageFile := range pageFiles {
+			if len(pageFile.Name) >= 2 {
+				usedBy(pageFile.Name[:2], "holds the page file "+pageFile.Name)
+			}
+		}
+	}
+
+	return class, nil
+}
+
+// ReloadPartitions asks the system to read the partition table again
+func ReloadPartitions(device string) error {
+	fd, err := windows.Open(device, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.Close(fd)
+
+	var bytesReturned uint32
+	return windows.DeviceIoControl(fd, C.IOCTL_DISK_UPDATE_PROPERTIES, nil, 0, nil, 0, &bytesReturned, nil)
+}
+
+// InvalidateCache does nothing, the reads and writes of physical drives
+// do not go through the system cache
+func InvalidateCache(device string) error {
+	return nil
+}
+
+// MountPartition is not supported, Windows mounts the volumes by itself
+func MountPartition(partition string, filesystem string) (string, error) {
+	return "", errors.New("Mounting partitions is not supported on Windows")
+}
+
+func UnmountPartition(mountpoint string) error {
+	return errors.New("Unmounting partitions is not supported on Windows")
+}
+
 func FindDeviceByUUID(uuid string) (string, error) {
 	return "", DeviceNotFound
 }
@@ -108,6 +274,16 @@ func getDiskFromPartition(partition string) (string, error) {
 	return "", DeviceNotFound
 }
 
+// PartitionDisk returns the disk holding the partition, given as a drive
+// letter such as \\.\X: or X:
+func PartitionDisk(partition string) (string, error) {
+	drive := strings.TrimSuffix(strings.TrimPrefix(partition, `\\.\`), `\`)
+	if len(drive) != 2 || drive[1] != ':' {
+		return "", fmt.Errorf("%s is not a drive letter", partition)
+	}
+	return getDiskFromPartition(strings.ToUpper(drive))
+}
+
 func getUsbDevices() (devices []USBDevice, err error) {
 	var logicalDisks []Win32_LogicalDisk
 	q := wmi.CreateQuery(&logicalDisks, "WHERE DriveType = 2")
@@ -149,6 +325,161 @@ func FindDeviceByPath(path string) (string, error) {
 	return "", DeviceNotFound
 }
 
+// ListDevices returns the removable and USB devices
+func ListDevices() ([]Device, error) {
+	var drives []win32DiskDriveInfo
+	if err := wmi.Query("SELECT DeviceID, Model, SerialNumber, InterfaceType, MediaType, Size FROM Win32_DiskDrive", &drives); err != nil {
+		return nil, err
+	}
+
+	var devices []Device
+	for _, drive := range drives {
+		if drive.InterfaceType != "USB" && !strings.HasPrefix(drive.MediaType, "Removable") {
+			continue
+		}
+
+		device := Device{
+			Device: drive.DeviceID,
+			Model:  drive.Model,
+			Serial: strings.TrimSpace(drive.SerialNumber),
+			Size:   drive.Size,
+		}
+
+		var parts []win32DiskPartitionInfo
+		query := fmt.Sprintf("ASSOCIATORS OF {Win32_DiskDrive.DeviceID=\"%s\"} WHERE AssocClass = Win32_DiskDriveToDiskPartition", strings.Replace(drive.DeviceID, `\`, `\\`, -1))
+		if err := wmi.Query(query, &parts); err != nil {
+			return nil, err
+		}
+
+		for _, part := range parts {
+			partition := Partition{Device: part.DeviceID, Size: part.Size}
+
+			var logicalDisks []win32LogicalDiskInfo
+			query := fmt.Sprintf("ASSOCIATORS OF {Win32_DiskPartition.DeviceID=\"%s\"} WHERE AssocClass = Win32_LogicalDiskToPartition", part.DeviceID)
+			if err := wmi.Query(query, &logicalDisks); err == nil && len(logicalDisks) > 0 {
+				logicalDisk := logicalDisks[0]
+				partition.Filesystem = strings.ToLower(logicalDisk.FileSystem)
+				if strings.HasPrefix(partition.Filesystem, "fat") {
+					partition.Filesystem = "fat"
+				}
+				partition.Label = logicalDisk.VolumeName
+				partition.Mountpoints = []string{logicalDisk.DeviceID + "\\"}
+				if serial := logicalDisk.VolumeSerialNumber; len(serial) == 8 {
+					partition.UUID = serial[:4] + "-" + serial[4:]
+				}
+			}
+
+			device.Partitions = append(device.Partitions, partition)
+		}
+
+		devices = append(devices, device)
+	}
+
+	return devices, nil
+}
+
+// DeviceMounts returns the volumes of the partitions of the device that
+// have a drive letter. The WMI partition index follows the enumeration
+// order, the partitions are numbered from the partition table instead,
+// by their starting offset.
+func DeviceMounts(device string) ([]MountedPartition, error) {
+	var parts []win32DiskPartitionInfo
+	query := fmt.Sprintf("ASSOCIATORS OF {Win32_DiskDrive.DeviceID=\"%s\"} WHERE AssocClass = Win32_DiskDriveToDiskPartition", strings.Replace(device, `\`, `\\`, -1))
+	if err := wmi.Query(query, &parts); err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		return nil, nil
+	}
+
+	sectorSize, _, err := GetSectorSize(device)
+	if err != nil {
+		return nil, err
+	}
+
+	// Volumes of devices without partition table start at offset 0
+	identity, err := readDiskIdentity(device)
+	if err != nil {
+		identity = &diskIdentity{}
+	}
+
+	var mounts []MountedPartition
+	for _, part := range parts {
+		var logicalDisks []win32LogicalDiskInfo
+		query := fmt.Sprintf("ASSOCIATORS OF {Win32_DiskPartition.DeviceID=\"%s\"} WHERE AssocClass = Win32_LogicalDiskToPartition", part.DeviceID)
+		if err := wmi.Query(query, &logicalDisks); err != nil {
+			return nil, err
+		}
+
+		if len(logicalDisks) == 0 {
+			continue
+		}
+
+		index, found := identity.Starts[part.StartingOffset/sectorSize]
+		if !found && part.StartingOffset != 0 {
+			return nil, fmt.Errorf("No partition of %s starts at offset %d", device, part.StartingOffset)
+		}
+
+		for _, logicalDisk := range logicalDisks {
+			mounts = append(mounts, MountedPartition{
+				Partition:  `\\.\` + logicalDisk.DeviceID,
+				Index:      index,
+				Mountpoint: logicalDisk.DeviceID + "\\",
+				Filesystem: strings.ToLower(logicalDisk.FileSystem),
+			})
+		}
+	}
+
+	return mounts, nil
+}
+
+// LockPartitions flushes, locks and dismounts the volumes. It fails if one
+// of them is in use. The volumes are mounted again when the locks are
+// released.
+func LockPartitions(mounts []MountedPartition) (*PartitionLock, error) {
+	lock := &PartitionLock{}
+
+	for _, m := range mounts {
+		log.Printf("Dismounting %s\n", m.Mountpoint)
+
+		fd, err := windows.Open(m.Partition, os.O_RDWR, 0)
+		if err != nil {
+			lock.Restore()
+			return nil, fmt.Errorf("Failed to open %s: %s", m.Partition, err.Error())
+		}
+
+		windows.FlushFileBuffers(fd)
+
+		var bytesReturned uint32
+		if err := windows.DeviceIoControl(fd, C.FSCTL_LOCK_VOLUME, nil, 0, nil, 0, &bytesReturned, nil); err != nil {
+			windows.Close(fd)
+			lock.Restore()
+			return nil, fmt.Errorf("Failed to lock %s, it may be in use: %s", m.Mountpoint, err.Error())
+		}
+
+		if err := windows.DeviceIoControl(fd, C.FSCTL_DISMOUNT_VOLUME, nil, 0, nil, 0, &bytesReturned, nil); err != nil {
+			windows.Close(fd)
+			lock.Restore()
+			return nil, fmt.Errorf("Failed to dismount %s: %s", m.Mountpoint, err.Error())
+		}
+
+		lock.files = append(lock.files, &windowsDevice{fd: fd})
+	}
+
+	return lock, nil
+}
+
+// Restore releases the locks on the volumes, Windows then mounts them
+// again on their next access
+func (lock *PartitionLock) Restore() error {
+	for _, file := range lock.files {
+		file.Close()
+	}
+	lock.files = nil
+	return nil
+}
+
 func RunAsRoot(executable string, args ...string) error {
 	return errors.New("Failed to find a way to run as root")
 }
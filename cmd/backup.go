@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/cobra"
+)
+
+var backupDevice string
+
+// backupTarget returns the device given on the command line, or the
+// device vlaunch was started from. Disks the host system depends on are
+// refused either way.
+func backupTarget() (string, error) {
+	if !backend.IsAdmin() {
+		return "", errors.New("Accessing the device requires administrator privileges")
+	}
+
+	if backupDevice == "" {
+		return backend.FindDevice()
+	}
+
+	if err := backend.CheckDevice(backupDevice); err != nil {
+		return "", err
+	}
+	return backupDevice, nil
+}
+
+var backupCmd = &cobra.Command{
+	Use:   "backup <out>",
+	Short: "Save the partition table and the partitions of the device to a compressed image",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected the location of the backup")
+		}
+
+		device, err := backupTarget()
+		if err != nil {
+			return err
+		}
+
+		return vmdk.Backup(args[0], device)
+	},
+}
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore <in>",
+	Short: "Write a backup created with the backup command to the device",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected the location of the backup")
+		}
+
+		// Overwriting the device vlaunch runs from must be asked for
+		if backupDevice == "" {
+			return errors.New("The device to restore must be given with --device")
+		}
+
+		device, err := backupTarget()
+		if err != nil {
+			return err
+		}
+
+		if backupLocation, err := backend.FindDeviceByPath(args[0]); err == nil && strings.EqualFold(backupLocation, device) {
+			return fmt.Errorf("The backup %s is stored on %s, copy it to another disk to restore it", args[0], device)
+		}
+
+		// Nothing is unmounted until the backup is known to be usable
+		if err := vmdk.VerifyBackup(args[0], device); err != nil {
+			return err
+		}
+
+		mounts, err := backend.DeviceMounts(device)
+		if err != nil {
+			return fmt.Errorf("Failed to list the mounts of %s: %s", device, err.Error())
+		}
+
+		// The filesystems are replaced, they are not mounted back
+		lock, err := backend.LockPartitions(mounts)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+
+		return vmdk.Restore(args[0], device)
+	},
+}
+
+func init() {
+	backupCmd.Flags().StringVarP(&backupDevice, "device", "d", "", "device to back up")
+	restoreCmd.Flags().StringVarP(&backupDevice, "device", "d", "", "device to restore, required")
+	RootCmd.AddCommand(backupCmd)
+	RootCmd.AddCommand(restoreCmd)
+}
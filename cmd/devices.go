@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/spf13/cobra"
+)
+
+var devicesJSON bool
+
+// formatSize returns the size in a human readable form
+func formatSize(size uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
+
+var devicesCmd = &cobra.Command{
+	Use:   "devices",
+	Short: "List the removable devices and the one vlaunch would start from",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		devices, err := backend.ListDevices()
+		if err != nil {
+			return fmt.Errorf("Failed to list devices: %s", err.Error())
+		}
+
+		selected, _ := backend.FindDevice()
+
+		if devicesJSON {
+			output := struct {
+				Selected string           `json:"selected,omitempty"`
+				Devices  []backend.Device `json:"devices"`
+			}{selected, devices}
+
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(output)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "DEVICE\tSIZE\tMODEL\tFILESYSTEM\tLABEL\tUUID\tMOUNTPOINTS")
+		for _, device := range devices {
+			name := device.Device
+			if strings.EqualFold(name, selected) {
+				name += " *"
+			}
+
+			description := strings.TrimSpace(device.Vendor + " " + device.Model)
+			if device.Serial != "" {
+				description += " (" + device.Serial + ")"
+			}
+
+			fmt.Fprintf(tw, "%s\t%s\t%s\t\t\t\t\n", name, formatSize(device.Size), description)
+			for _, part := range device.Partitions {
+				fmt.Fprintf(tw, "  %s\t%s\t\t%s\t%s\t%s\t%s\n", part.Device, formatSize(part.Size),
+					part.Filesystem, part.Label, part.UUID, strings.Join(part.Mountpoints, ","))
+			}
+		}
+		tw.Flush()
+
+		if selected != "" {
+			fmt.Printf("\nvlaunch would start from %s\n", selected)
+		} else {
+			fmt.Println("\nvlaunch could not find the device to start from")
+		}
+
+		return nil
+	},
+}
+
+func init() {
+	devicesCmd.Flags().BoolVarP(&devicesJSON, "json", "j", false, "print the devices as JSON")
+	RootCmd.AddCommand(devicesCmd)
+}
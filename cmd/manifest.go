@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/cobra"
+)
+
+var (
+	manifestDevice     string
+	manifestKey        string
+	manifestOutput     string
+	manifestPartitions []string
+)
+
+var ManifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "Manage the manifest the device is verified against before booting",
+}
+
+var manifestCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Hash the partition table and the selected partitions into a signed manifest",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !backend.IsAdmin() {
+			return errors.New("Creating a manifest requires administrator privileges")
+		}
+
+		if manifestKey == "" {
+			return errors.New("A private key is required to sign the manifest")
+		}
+
+		key, err := vmdk.LoadPrivateKey(manifestKey)
+		if err != nil {
+			return err
+		}
+
+		device := manifestDevice
+		if device == "" {
+			if device, err = backend.FindDevice(); err != nil {
+				return err
+			}
+		}
+
+		manifest, err := vmdk.CreateManifest(device, manifestPartitions)
+		if err != nil {
+			return fmt.Errorf("Failed to create manifest: %s", err.Error())
+		}
+
+		if err := manifest.Sign(key); err != nil {
+			return fmt.Errorf("Failed to sign manifest: %s", err.Error())
+		}
+
+		output := manifestOutput
+		if output == "" {
+			output = vm.ManifestLocation()
+		}
+
+		log.Printf("Writing manifest of %s to %s\n", device, output)
+		return manifest.Write(output)
+	},
+}
+
+func init() {
+	manifestCreateCmd.Flags().StringVarP(&manifestDevice, "device", "d", "", "device to create the manifest for")
+	manifestCreateCmd.Flags().StringVarP(&manifestKey, "key", "k", "", "PEM encoded EC private key used to sign the manifest")
+	manifestCreateCmd.Flags().StringVarP(&manifestOutput, "output", "o", "", "location of the manifest")
+	manifestCreateCmd.Flags().StringSliceVarP(&manifestPartitions, "partition", "p", nil, "partition to hash, by index, GUID or label")
+	ManifestCmd.AddCommand(manifestCreateCmd)
+	RootCmd.AddCommand(ManifestCmd)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/cobra"
+)
+
+var OverlayCmd = &cobra.Command{
+	Use:   "overlay",
+	Short: "Manage the overlay that receives the guest writes in overlay mode",
+}
+
+var overlayCommitCmd = &cobra.Command{
+	Use:   "commit",
+	Short: "Write the changes stored in the overlay to the device and discard it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !backend.IsAdmin() {
+			return errors.New("Committing the overlay requires administrator privileges")
+		}
+
+		// The overlay of other disk types is not based on the device
+		if diskType := config.GetConfig().GetString("disk_type"); diskType != "raw" {
+			return fmt.Errorf("Committing the overlay is only supported for raw disks, not '%s'", diskType)
+		}
+
+		location := vm.OverlayLocation()
+		if _, err := os.Stat(location); err != nil {
+			return fmt.Errorf("No overlay found: %s", err.Error())
+		}
+
+		device, err := backend.FindDevice()
+		if err != nil {
+			return err
+		}
+
+		// The partitions are unmounted while the overlay is written back
+		if overlayDevice, err := backend.FindDeviceByPath(location); err == nil && strings.EqualFold(overlayDevice, device) {
+			return fmt.Errorf("The overlay %s is stored on %s, move it to another disk and set data_path to commit it", location, device)
+		}
+
+		policy, shared, err := vm.DevicePolicy(device)
+		if err != nil {
+			return err
+		}
+
+		lock, err := vm.ReleasePartitions(device, shared)
+		if err != nil {
+			return err
+		}
+
+		err = vmdk.CommitOverlay(location, device, policy)
+		if lock != nil {
+			if err := lock.Restore(); err != nil {
+				log.Printf("%s\n", err.Error())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to commit overlay: %s", err.Error())
+		}
+
+		return os.Remove(location)
+	},
+}
+
+var overlayDiscardCmd = &cobra.Command{
+	Use:   "discard",
+	Short: "Discard the changes stored in the overlay",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location := vm.OverlayLocation()
+		if err := os.Remove(location); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	OverlayCmd.AddCommand(overlayCommitCmd)
+	OverlayCmd.AddCommand(overlayDiscardCmd)
+	RootCmd.AddCommand(OverlayCmd)
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/config"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/cobra"
+)
+
+var (
+	prepareDevice     string
+	preparePartition  int
+	prepareMountpoint string
+	prepareForce      bool
+)
+
+// copyFile copies the file at src to dst with the given mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+var prepareCmd = &cobra.Command{
+	Use:   "prepare <image>",
+	Short: "Write an OS image to a removable device and install vlaunch on it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected the image to write")
+		}
+
+		if !backend.IsAdmin() {
+			return errors.New("Preparing a device requires administrator privileges")
+		}
+
+		// The device is never guessed as its content is overwritten
+		if prepareDevice == "" {
+			return errors.New("The device to prepare must be specified")
+		}
+
+		removable, err := backend.IsRemovable(prepareDevice)
+		if err != nil {
+			return fmt.Errorf("Failed to check whether %s is removable: %s", prepareDevice, err.Error())
+		}
+
+		if !removable && !prepareForce {
+			return fmt.Errorf("%s is not a removable device, use --force to prepare it anyway", prepareDevice)
+		}
+
+		// USB disks the host runs from are removable too
+		if err := backend.CheckDevice(prepareDevice); err != nil {
+			return err
+		}
+
+		mounts, err := backend.DeviceMounts(prepareDevice)
+		if err != nil {
+			return fmt.Errorf("Failed to list the mounts of %s: %s", prepareDevice, err.Error())
+		}
+
+		// The filesystems are replaced by the ones of the image, they are
+		// not mounted back
+		lock, err := backend.LockPartitions(mounts)
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+
+		lastPercent := map[string]uint64{}
+		progress := func(pass string, done, total uint64) {
+			if percent := done * 100 / total; percent/10 != lastPercent[pass]/10 || done == total {
+				log.Printf("%s: %d%%\n", pass, percent)
+				lastPercent[pass] = percent
+			}
+		}
+
+		log.Printf("Writing %s to %s\n", args[0], prepareDevice)
+		if err := vmdk.WriteImage(args[0], prepareDevice, progress); err != nil {
+			return err
+		}
+		lock.Unlock()
+
+		if err := backend.ReloadPartitions(prepareDevice); err != nil {
+			log.Printf("Failed to reload partition table of %s: %s\n", prepareDevice, err.Error())
+		}
+
+		volume, err := vmdk.FindVolume(prepareDevice, preparePartition)
+		if err != nil {
+			return err
+		}
+		log.Printf("Installing vlaunch on partition %d (%s, UUID %s)\n", volume.Index, volume.Filesystem, volume.UUID)
+
+		mountpoint := prepareMountpoint
+		if mountpoint == "" {
+			partitions, err := backend.GetPartitionDevices(prepareDevice)
+			if err != nil {
+				return fmt.Errorf("Failed to list partitions of %s, use --mountpoint: %s", prepareDevice, err.Error())
+			}
+
+			partition, found := partitions[volume.Offset/512]
+			if !found {
+				return fmt.Errorf("Could not find device for partition %d of %s", volume.Index, prepareDevice)
+			}
+
+			if mountpoint, err = backend.MountPartition(partition, volume.Filesystem); err != nil {
+				return err
+			}
+			defer backend.UnmountPartition(mountpoint)
+		}
+
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		if err := copyFile(executable, filepath.Join(mountpoint, filepath.Base(executable)), 0755); err != nil {
+			return fmt.Errorf("Failed to copy vlaunch: %s", err.Error())
+		}
+
+		content := fmt.Sprintf("# Generated by vlaunch prepare\ndevice_uuid: %q\n", volume.UUID)
+		configLocation := filepath.Join(mountpoint, config.DefaultConfigFile)
+		if err := ioutil.WriteFile(configLocation, []byte(content), 0644); err != nil {
+			return fmt.Errorf("Failed to write configuration: %s", err.Error())
+		}
+
+		log.Printf("%s is ready\n", prepareDevice)
+		return nil
+	},
+}
+
+func init() {
+	prepareCmd.Flags().StringVarP(&prepareDevice, "device", "d", "", "device to write the image to")
+	prepareCmd.Flags().IntVarP(&preparePartition, "partition", "p", 0, "partition to install vlaunch on, the first FAT, exFAT or NTFS one by default")
+	prepareCmd.Flags().StringVarP(&prepareMountpoint, "mountpoint", "m", "", "where the partition is mounted, it is mounted temporarily if not set")
+	prepareCmd.Flags().BoolVarP(&prepareForce, "force", "f", false, "prepare the device even if it is not removable")
+	RootCmd.AddCommand(prepareCmd)
+}
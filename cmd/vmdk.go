@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/lebauce/vlaunch/vm"
+	"github.com/lebauce/vlaunch/vmdk"
+	"github.com/spf13/cobra"
+)
+
+var (
+	inspectDevice string
+	createDevice  string
+	createImage   string
+	createFormat  string
+	createAdapter string
+)
+
+var VMDKCmd = &cobra.Command{
+	Use:   "vmdk",
+	Short: "Create and inspect VMDK descriptors",
+}
+
+var vmdkInspectCmd = &cobra.Command{
+	Use:   "inspect <file>",
+	Short: "Print the extent map of a descriptor against the partition table of the device",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected the descriptor to inspect")
+		}
+
+		device := inspectDevice
+		if device == "" {
+			var err error
+			if device, err = backend.FindDevice(); err != nil {
+				return err
+			}
+		}
+
+		return vmdk.Inspect(os.Stdout, args[0], device)
+	},
+}
+
+var vmdkCreateCmd = &cobra.Command{
+	Use:   "create <file>",
+	Short: "Create a descriptor of the device or disk image for a hypervisor",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("Expected the descriptor to create")
+		}
+
+		opts := vmdk.RawOptions{
+			Partitions: true,
+			Policy:     vm.PartitionPolicy(),
+			Output:     vmdk.OutputOptions{Format: createFormat, AdapterType: createAdapter},
+		}
+
+		if createImage != "" {
+			return vmdk.CreateImageVMDK(args[0], createImage, opts)
+		}
+
+		device := createDevice
+		if device == "" {
+			var err error
+			if device, err = backend.FindDevice(); err != nil {
+				return err
+			}
+		} else if err := backend.CheckDevice(device); err != nil {
+			return err
+		}
+
+		// Partition device nodes are only understood by VirtualBox
+		if createFormat == vmdk.FormatVirtualBox {
+			opts.Relative = backend.RelativeRawVMDK
+		}
+
+		return vmdk.CreateRawVMDK(args[0], device, opts)
+	},
+}
+
+func init() {
+	vmdkCreateCmd.Flags().StringVarP(&createDevice, "device", "d", "", "device to create the descriptor for")
+	vmdkCreateCmd.Flags().StringVarP(&createImage, "image", "i", "", "disk image to create the descriptor for, instead of a device")
+	vmdkCreateCmd.Flags().StringVarP(&createFormat, "format", "f", vmdk.FormatVirtualBox, "descriptor format (virtualbox, vmware or qemu)")
+	vmdkCreateCmd.Flags().StringVarP(&createAdapter, "adapter", "a", vmdk.AdapterIDE, "adapter type (ide, lsilogic, buslogic or pvscsi)")
+	VMDKCmd.AddCommand(vmdkCreateCmd)
+
+	vmdkInspectCmd.Flags().StringVarP(&inspectDevice, "device", "d", "", "device to check the descriptor against")
+	VMDKCmd.AddCommand(vmdkInspectCmd)
+	RootCmd.AddCommand(VMDKCmd)
+}
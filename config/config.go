@@ -12,14 +12,35 @@ import (
 
 var cfg *viper.Viper
 
+// DefaultConfigFile is the configuration file loaded from the folder of
+// the executable when none is given
+const DefaultConfigFile = "vlaunch.yml"
+
 func InitConfig(cfgFiles []string) error {
 	cfg = viper.New()
 	cfg.SetConfigType("yaml")
-	cfg.SetDefault("distro_type", "Linux_64")
 	cfg.SetDefault("disk_type", "raw")
+	cfg.SetDefault("disk_mode", "direct")
+	cfg.SetDefault("data_disk_size", 4096)
+	cfg.SetDefault("disk_size", 8192)
+	cfg.SetDefault("firmware", "auto")
+	cfg.SetDefault("allow_system_disk", false)
+	cfg.SetDefault("host_mounts", "unmount")
+	cfg.SetDefault("self_partition", "readonly")
+	cfg.SetDefault("manifest.verify", "sampled")
+	cfg.SetDefault("manifest.on_mismatch", "refuse")
 	cfg.SetDefault("gui", true)
 	cfg.SetDefault("menubar", false)
 
+	if len(cfgFiles) == 0 {
+		if executableFolder, err := osext.ExecutableFolder(); err == nil {
+			defaultFile := path.Join(executableFolder, DefaultConfigFile)
+			if _, err := os.Stat(defaultFile); err == nil {
+				cfgFiles = []string{defaultFile}
+			}
+		}
+	}
+
 	for _, path := range cfgFiles {
 		configFile, err := os.Open(path)
 		if err != nil {
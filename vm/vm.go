@@ -1,13 +1,19 @@
 package vm
 
 import (
+	"crypto/ecdsa"
 	"fmt"
 	"log"
+	"os"
 	"path"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/lebauce/vbox"
 	"github.com/lebauce/vlaunch/backend"
 	"github.com/lebauce/vlaunch/config"
@@ -16,6 +22,9 @@ import (
 
 var controllerName = "IDE"
 
+// defaultOSType is used when the OS type is neither configured nor detected
+const defaultOSType = "Linux_64"
+
 type EventHandler interface {
 	OnGuestPropertyChanged(name, value string, timestamp int64, flags string)
 }
@@ -26,8 +35,16 @@ type VirtualMachine struct {
 	controller    vbox.StorageController
 	session       vbox.Session
 	dd            vbox.Medium
-	wg            sync.WaitGroup
-	eventHandlers []EventHandler
+	overlay       *vbox.Medium
+	dvd           *vbox.Medium
+	keptMedia     []vbox.Medium
+	device        string
+	diskLocation  string
+	partitionLock *backend.PartitionLock
+	// sharedPartitions are the partitions that stay mounted on the host
+	sharedPartitions map[int]bool
+	wg               sync.WaitGroup
+	eventHandlers    []EventHandler
 }
 
 func (vm *VirtualMachine) OnStateChanged(event vbox.Event) {
@@ -176,6 +193,8 @@ func (vm *VirtualMachine) pollingLoop() error {
 }
 
 func (vm *VirtualMachine) Run() (err error) {
+	defer vm.restorePartitions()
+
 	var wg sync.WaitGroup
 
 	wg.Add(1)
@@ -192,16 +211,31 @@ func (vm *VirtualMachine) Run() (err error) {
 	}()
 
 	wg.Wait()
+
+	// Guest writes to the partition table header only reach a copy of it,
+	// write them back now that the machine is off, even if it is kept
+	if vm.device != "" && vm.overlay == nil {
+		if err := vmdk.SyncHeader(vm.diskLocation, vm.device); err != nil {
+			log.Printf("Failed to write back partition table header: %s\n", err.Error())
+		}
+	}
+
 	return err
 }
 
 func (vm *VirtualMachine) Start() error {
+	if err := vm.releasePartitions(); err != nil {
+		return err
+	}
+
 	progress, err := vm.machine.Launch(vm.session, "gui", "")
 	if err != nil {
+		vm.restorePartitions()
 		return err
 	}
 
 	if err = progress.WaitForCompletion(50000); err != nil {
+		vm.restorePartitions()
 		return err
 	}
 	progress.Release()
@@ -220,6 +254,8 @@ func (vm *VirtualMachine) Stop() error {
 }
 
 func (vm *VirtualMachine) Release() error {
+	vm.restorePartitions()
+
 	if err := vm.session.UnlockMachine(); err != nil {
 		return err
 	}
@@ -229,7 +265,14 @@ func (vm *VirtualMachine) Release() error {
 		return err
 	}
 
-	media, err := vm.machine.Unregister(vbox.CleanupMode_Full)
+	cleanupMode := uint32(vbox.CleanupMode_Full)
+	if len(vm.keptMedia) > 0 {
+		// Keep the media that must survive the session, such as the
+		// overlay or the ISO, and only close them afterwards
+		cleanupMode = vbox.CleanupMode_DetachAllReturnNone
+	}
+
+	media, err := vm.machine.Unregister(cleanupMode)
 	if err != nil {
 		return err
 	}
@@ -248,6 +291,12 @@ func (vm *VirtualMachine) Release() error {
 		return err
 	}
 
+	for _, medium := range vm.keptMedia {
+		if err := medium.Close(); err != nil {
+			return err
+		}
+	}
+
 	/*
 		if err := vm.session.Release(); err != nil {
 			return err
@@ -266,7 +315,39 @@ func (vm *VirtualMachine) Create() error {
 	}
 
 	diskLocation := ""
+	isoLocation := ""
+	keepDisk := false
 	diskType := cfg.GetString("disk_type")
+
+	diskMode := cfg.GetString("disk_mode")
+	switch diskMode {
+	case "direct", "overlay":
+	default:
+		return fmt.Errorf("Invalid disk mode '%s'", diskMode)
+	}
+
+	switch hostMounts := cfg.GetString("host_mounts"); hostMounts {
+	case "unmount", "keep":
+	default:
+		return fmt.Errorf("Invalid host mounts mode '%s'", hostMounts)
+	}
+
+	switch selfPartition := cfg.GetString("self_partition"); selfPartition {
+	case "readonly", "hide":
+	default:
+		return fmt.Errorf("Invalid self partition policy '%s'", selfPartition)
+	}
+
+	firmware := cfg.GetString("firmware")
+	switch firmware {
+	case "auto", vmdk.FirmwareBIOS, vmdk.FirmwareEFI:
+	default:
+		return fmt.Errorf("Invalid firmware '%s'", firmware)
+	}
+
+	// bootLocation is the disk whose partition table tells the firmware
+	bootLocation := ""
+
 	switch diskType {
 	case "raw":
 		device, err := backend.FindDevice()
@@ -274,24 +355,175 @@ func (vm *VirtualMachine) Create() error {
 			return err
 		}
 
+		if err := verifyManifest(device); err != nil {
+			return err
+		}
+
+		policy, shared, err := DevicePolicy(device)
+		if err != nil {
+			return err
+		}
+		vm.sharedPartitions = shared
+
+		opts := vmdk.RawOptions{
+			Partitions: true,
+			Relative:   backend.RelativeRawVMDK,
+			ReadOnly:   diskMode == "overlay",
+			Policy:     policy,
+		}
+
+		if opts.ReadOnly {
+			opts.UUID = overlayBaseUUID()
+		}
+
 		log.Printf("Creating raw VMDK for device %s\n", device)
 		diskLocation = path.Join(settingsPath, "raw.vmdk")
-		if err := vmdk.CreateRawVMDK(diskLocation, device, true, backend.RelativeRawVMDK); err != nil {
+		if err := vmdk.CreateRawVMDK(diskLocation, device, opts); err != nil {
 			return err
 		}
+
+		vm.device = device
+		vm.diskLocation = diskLocation
+		bootLocation = device
+	case "image":
+		imageLocation := cfg.GetString("disk_location")
+		if imageLocation == "" {
+			return fmt.Errorf("No disk location specified for disk type '%s'", diskType)
+		}
+
+		log.Printf("Creating VMDK for image %s\n", imageLocation)
+		diskLocation = path.Join(settingsPath, "image.vmdk")
+		opts := vmdk.RawOptions{
+			ReadOnly: diskMode == "overlay",
+			Policy:   PartitionPolicy(),
+		}
+
+		if opts.ReadOnly {
+			opts.UUID = overlayBaseUUID()
+		}
+
+		if err := vmdk.CreateImageVMDK(diskLocation, imageLocation, opts); err != nil {
+			return err
+		}
+		bootLocation = imageLocation
+	case "partition":
+		source := cfg.GetString("disk_location")
+		if source == "" {
+			return fmt.Errorf("No disk location specified for disk type '%s'", diskType)
+		}
+
+		// Partitions of the disks the host depends on are refused, disk
+		// images are not checked
+		if fi, err := os.Stat(source); err != nil || !fi.Mode().IsRegular() {
+			if err := backend.CheckPartition(source); err != nil {
+				return err
+			}
+		}
+
+		log.Printf("Creating VMDK around partition %s\n", source)
+		diskLocation = path.Join(settingsPath, "partition.vmdk")
+		opts := vmdk.SyntheticOptions{
+			GPT:      cfg.GetString("partition_table") == "gpt",
+			ReadOnly: diskMode == "overlay",
+		}
+
+		if opts.ReadOnly {
+			opts.UUID = overlayBaseUUID()
+		}
+
+		if err := vmdk.CreatePartitionVMDK(diskLocation, source, opts); err != nil {
+			return err
+		}
+	case "iso":
+		if isoLocation = cfg.GetString("disk_location"); isoLocation == "" {
+			return fmt.Errorf("No disk location specified for disk type '%s'", diskType)
+		}
+
+		diskLocation = path.Join(settingsPath, "data.vdi")
+		if err := createDataDisk(diskLocation, uint64(cfg.GetInt("data_disk_size"))); err != nil {
+			return fmt.Errorf("Failed to create data disk: %s", err.Error())
+		}
 	case "vdi":
-		diskLocation = cfg.GetString("disk_location")
+		if diskLocation = cfg.GetString("disk_location"); diskLocation == "" {
+			diskLocation = path.Join(settingsPath, "disk.vdi")
+		}
+
+		if _, err := os.Stat(diskLocation); os.IsNotExist(err) {
+			size := uint64(cfg.GetInt("disk_size")) * 1024 * 1024
+			if err := vmdk.CreateSparseDisk(diskLocation, size, cfg.GetString("disk_template")); err != nil {
+				return fmt.Errorf("Failed to create disk: %s", err.Error())
+			}
+		}
+		keepDisk = true
+		bootLocation = diskLocation
 	default:
 		return fmt.Errorf("Invalid disk type '%s'", diskType)
 	}
 
-	dd, err := vbox.OpenMedium(diskLocation, vbox.DeviceType_HardDisk,
-		vbox.AccessMode_ReadWrite, false)
+	if firmware == "auto" {
+		firmware = vmdk.FirmwareBIOS
+		if bootLocation != "" {
+			detected, err := vmdk.DetectFirmware(bootLocation)
+			if err != nil {
+				log.Printf("Failed to detect firmware of %s: %s\n", bootLocation, err.Error())
+			} else {
+				firmware = detected
+			}
+		}
+	}
+
+	accessMode := uint32(vbox.AccessMode_ReadWrite)
+	if diskMode == "overlay" {
+		accessMode = vbox.AccessMode_ReadOnly
+	}
+
+	dd, err := vbox.OpenMedium(diskLocation, vbox.DeviceType_HardDisk, accessMode, false)
 	if err != nil {
 		return err
 	}
 
-	machine, err := vbox.CreateMachine(settingsPath, "ufo", cfg.GetString("distro_type"), "")
+	media := map[string]vbox.Medium{mediumDisk: dd}
+	disk := dd
+	if diskMode == "overlay" {
+		overlay, err := openOverlay(dd)
+		if err != nil {
+			return fmt.Errorf("Failed to open overlay: %s", err.Error())
+		}
+		vm.overlay = &overlay
+		media[mediumOverlay] = overlay
+		disk = overlay
+	}
+
+	if isoLocation != "" {
+		log.Printf("Using ISO %s\n", isoLocation)
+		dvd, err := vbox.OpenMedium(isoLocation, vbox.DeviceType_DVD, vbox.AccessMode_ReadOnly, false)
+		if err != nil {
+			return err
+		}
+		vm.dvd = &dvd
+		media[mediumDVD] = dvd
+	}
+
+	// Unregistering the machine must not delete these media
+	for _, name := range keptMedia(keepDisk, vm.overlay != nil, vm.dvd != nil) {
+		vm.keptMedia = append(vm.keptMedia, media[name])
+	}
+
+	osType := cfg.GetString("distro_type")
+	if osType == "" {
+		osType = defaultOSType
+		if bootLocation != "" {
+			detected, err := vmdk.DetectOSType(bootLocation)
+			if err != nil {
+				log.Printf("Failed to detect OS type of %s: %s\n", bootLocation, err.Error())
+			} else {
+				osType = detected
+			}
+		}
+	}
+	log.Printf("Using OS type %s\n", osType)
+
+	machine, err := vbox.CreateMachine(settingsPath, "ufo", osType, "")
 	if err != nil {
 		return err
 	}
@@ -321,6 +553,13 @@ func (vm *VirtualMachine) Create() error {
 		return err
 	}
 
+	log.Printf("Using %s firmware\n", firmware)
+	if firmware == vmdk.FirmwareEFI {
+		if err := machine.SetFirmwareType(vbox.FirmwareType_EFI); err != nil {
+			return err
+		}
+	}
+
 	biosSettings, err := machine.GetBiosSettings()
 	if err != nil {
 		return err
@@ -416,10 +655,17 @@ func (vm *VirtualMachine) Create() error {
 		return err
 	}
 
-	if err := smachine.AttachDevice(controllerName, 0, 0, vbox.DeviceType_HardDisk, dd); err != nil {
+	if err := smachine.AttachDevice(controllerName, 0, 0, vbox.DeviceType_HardDisk, disk); err != nil {
 		return err
 	}
 
+	// The default boot order tries the optical drive before the hard disk
+	if vm.dvd != nil {
+		if err := smachine.AttachDevice(controllerName, 1, 0, vbox.DeviceType_DVD, *vm.dvd); err != nil {
+			return err
+		}
+	}
+
 	if err = smachine.SaveSettings(); err != nil {
 		return err
 	}
@@ -436,6 +682,271 @@ func (vm *VirtualMachine) Create() error {
 	return nil
 }
 
+// PartitionPolicy returns the partitions exposed to the guest, as
+// configured in the partitions section
+func PartitionPolicy() vmdk.PartitionPolicy {
+	cfg := config.GetConfig()
+	return vmdk.PartitionPolicy{
+		Include:  cfg.GetStringSlice("partitions.include"),
+		ReadOnly: cfg.GetStringSlice("partitions.readonly"),
+		Hide:     cfg.GetStringSlice("partitions.hide"),
+	}
+}
+
+// isUnder returns whether location is inside the directory dir
+func isUnder(location string, dir string) bool {
+	location, dir = filepath.Clean(location), filepath.Clean(dir)
+	if runtime.GOOS == "windows" {
+		location, dir = strings.ToLower(location), strings.ToLower(dir)
+	}
+
+	return location == dir || strings.HasPrefix(location, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+const (
+	mediumDisk    = "disk"
+	mediumOverlay = "overlay"
+	mediumDVD     = "dvd"
+)
+
+// keptMedia returns the media to close once the machine is unregistered
+// instead of deleting them with it, each of them once and the overlay
+// before the disk it is based on. The disk is kept along with the overlay
+// and with the DVD, whose data disk is persistent.
+func keptMedia(keepDisk bool, overlay bool, dvd bool) []string {
+	var media []string
+	if overlay {
+		media = append(media, mediumOverlay)
+	}
+	if dvd {
+		media = append(media, mediumDVD)
+	}
+	if keepDisk || overlay || dvd {
+		media = append(media, mediumDisk)
+	}
+	return media
+}
+
+// DevicePolicy returns the partitions of the device exposed to the guest
+// and the partitions mounted by the host that stay mounted. The ones
+// holding vlaunch or its data path, or all of them if host_mounts is set
+// to keep, are shared with the host and exposed to the guest read-only or
+// hidden, as configured by self_partition.
+func DevicePolicy(device string) (vmdk.PartitionPolicy, map[int]bool, error) {
+	cfg := config.GetConfig()
+	policy := PartitionPolicy()
+	mounts, err := backend.DeviceMounts(device)
+	if err != nil {
+		return policy, nil, fmt.Errorf("Failed to list the mounts of %s: %s", device, err.Error())
+	}
+
+	selfLocations := []string{cfg.GetString("data_path")}
+	if executable, err := os.Executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+			executable = resolved
+		}
+		selfLocations = append(selfLocations, executable)
+	}
+
+	shared := make(map[int]bool)
+	for _, m := range mounts {
+		if cfg.GetString("host_mounts") == "keep" {
+			shared[m.Index] = true
+		}
+		for _, location := range selfLocations {
+			if location != "" && isUnder(location, m.Mountpoint) {
+				shared[m.Index] = true
+			}
+		}
+	}
+
+	for index := range shared {
+		if index == 0 {
+			return policy, nil, fmt.Errorf("The filesystem of %s spans the whole device and stays mounted on the host, it cannot be shared with the guest", device)
+		}
+
+		if cfg.GetString("self_partition") == "hide" {
+			log.Printf("Partition %d stays mounted on the host and is hidden from the guest\n", index)
+			policy.Hide = append(policy.Hide, strconv.Itoa(index))
+		} else {
+			log.Printf("Partition %d stays mounted on the host and is read-only for the guest\n", index)
+			policy.ReadOnly = append(policy.ReadOnly, strconv.Itoa(index))
+		}
+	}
+
+	return policy, shared, nil
+}
+
+// ReleasePartitions unmounts the partitions of the device that are not
+// shared with the host and keeps them locked. It returns nil if there is
+// nothing to release.
+func ReleasePartitions(device string, shared map[int]bool) (*backend.PartitionLock, error) {
+	mounts, err := backend.DeviceMounts(device)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the mounts of %s: %s", device, err.Error())
+	}
+
+	var released []backend.MountedPartition
+	for _, m := range mounts {
+		if !shared[m.Index] {
+			released = append(released, m)
+		}
+	}
+
+	if len(released) == 0 {
+		return nil, nil
+	}
+
+	return backend.LockPartitions(released)
+}
+
+// releasePartitions releases the partitions of the device until the
+// machine stops
+func (vm *VirtualMachine) releasePartitions() error {
+	if vm.device == "" {
+		return nil
+	}
+
+	lock, err := ReleasePartitions(vm.device, vm.sharedPartitions)
+	if err != nil {
+		return err
+	}
+
+	vm.partitionLock = lock
+	return nil
+}
+
+// restorePartitions gives the partitions released for the session back to
+// the host
+func (vm *VirtualMachine) restorePartitions() {
+	if vm.partitionLock == nil {
+		return
+	}
+
+	if err := vm.partitionLock.Restore(); err != nil {
+		log.Printf("%s\n", err.Error())
+	}
+	vm.partitionLock = nil
+}
+
+// createDataDisk creates a dynamically allocated VDI of size megabytes at
+// location, unless it already exists
+func createDataDisk(location string, size uint64) error {
+	if _, err := os.Stat(location); err == nil {
+		log.Printf("Using existing data disk %s\n", location)
+		return nil
+	}
+
+	log.Printf("Creating data disk %s of %d MB\n", location, size)
+	return vmdk.CreateSparseDisk(location, size*1024*1024, "")
+}
+
+// ManifestLocation returns the location of the manifest the device is
+// verified against
+func ManifestLocation() string {
+	cfg := config.GetConfig()
+	if location := cfg.GetString("manifest.location"); location != "" {
+		return location
+	}
+	return path.Join(cfg.GetString("data_path"), "manifest.json")
+}
+
+// verifyManifest checks the device against its manifest, if there is one
+// or if a public key is configured to check it. A manifest is only trusted
+// once its signature is checked, as it may live on the device it protects.
+// Only raw devices are verified.
+func verifyManifest(device string) error {
+	cfg := config.GetConfig()
+	location := ManifestLocation()
+	publicKey := cfg.GetString("manifest.public_key")
+
+	if _, err := os.Stat(location); os.IsNotExist(err) && publicKey == "" {
+		return nil
+	}
+
+	manifest, err := vmdk.ReadManifest(location)
+	if err != nil {
+		return manifestMismatch(err)
+	}
+
+	if publicKey != "" {
+		var key *ecdsa.PublicKey
+		if key, err = vmdk.LoadPublicKey(publicKey); err == nil {
+			err = manifest.VerifySignature(key)
+		}
+	} else {
+		err = fmt.Errorf("No public key configured to check the signature of %s", location)
+	}
+
+	if err != nil {
+		if err := manifestMismatch(err); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Verifying %s against manifest %s\n", device, location)
+	if err := manifest.Verify(device, cfg.GetString("manifest.verify") != "full"); err != nil {
+		return manifestMismatch(err)
+	}
+
+	return nil
+}
+
+// manifestMismatch refuses the device, or only logs the problem if
+// manifest.on_mismatch is set to warn
+func manifestMismatch(err error) error {
+	if config.GetConfig().GetString("manifest.on_mismatch") == "warn" {
+		log.Printf("Device does not match its manifest: %s\n", err.Error())
+		return nil
+	}
+	return fmt.Errorf("Device does not match its manifest: %s", err.Error())
+}
+
+// overlayBaseUUID returns the UUID of the base the existing overlay refers
+// to, so that a regenerated descriptor still matches it, or a nil UUID if
+// there is no overlay yet
+func overlayBaseUUID() uuid.UUID {
+	parentUUID, err := vmdk.OverlayParentUUID(OverlayLocation())
+	if err != nil {
+		return uuid.Nil
+	}
+	return parentUUID
+}
+
+// OverlayLocation returns the location of the differencing image that
+// receives the guest writes in overlay mode
+func OverlayLocation() string {
+	return path.Join(config.GetConfig().GetString("data_path"), "overlay.vdi")
+}
+
+// openOverlay opens the overlay of the base medium, creating it if it
+// does not exist yet
+func openOverlay(base vbox.Medium) (vbox.Medium, error) {
+	location := OverlayLocation()
+	if _, err := os.Stat(location); err == nil {
+		log.Printf("Using existing overlay %s\n", location)
+		return vbox.OpenMedium(location, vbox.DeviceType_HardDisk, vbox.AccessMode_ReadWrite, false)
+	}
+
+	log.Printf("Creating overlay %s\n", location)
+	overlay, err := vbox.CreateHardDisk("VDI", location)
+	if err != nil {
+		return overlay, err
+	}
+
+	progress, err := base.CreateDiffStorage(overlay, []uint32{vbox.MediumVariant_Standard})
+	if err != nil {
+		return overlay, err
+	}
+	defer progress.Release()
+
+	if err = progress.WaitForCompletion(-1); err != nil {
+		return overlay, err
+	}
+
+	return overlay, nil
+}
+
 func NewVM() (*VirtualMachine, error) {
 	return &VirtualMachine{}, nil
 }
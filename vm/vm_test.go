@@ -0,0 +1,29 @@
+package vm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKeptMedia(t *testing.T) {
+	tests := []struct {
+		name     string
+		keepDisk bool
+		overlay  bool
+		dvd      bool
+		media    []string
+	}{
+		{name: "raw disk"},
+		{name: "vdi disk", keepDisk: true, media: []string{mediumDisk}},
+		{name: "overlay", overlay: true, media: []string{mediumOverlay, mediumDisk}},
+		{name: "vdi disk with overlay", keepDisk: true, overlay: true, media: []string{mediumOverlay, mediumDisk}},
+		{name: "iso", dvd: true, media: []string{mediumDVD, mediumDisk}},
+		{name: "iso with overlay", overlay: true, dvd: true, media: []string{mediumOverlay, mediumDVD, mediumDisk}},
+	}
+
+	for _, test := range tests {
+		if media := keptMedia(test.keepDisk, test.overlay, test.dvd); !reflect.DeepEqual(media, test.media) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.media, media)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// backupMagic starts the uncompressed backup stream
+const backupMagic = "VLBACKUP"
+
+// backupBufferSize is the size of the chunks copied from and to the device
+const backupBufferSize = 1 << 20
+
+// backupMaxHeaderSize bounds the size of the header of backups
+const backupMaxHeaderSize = 16 << 20
+
+// backupRange is a range of sectors stored in a backup
+type backupRange struct {
+	FirstLBA uint64 `json:"first_lba"`
+	Sectors  uint64 `json:"sectors"`
+}
+
+// backupHeader describes the content of a backup. It is followed by the
+// data of each range and its SHA-256 checksum.
+type backupHeader struct {
+	DeviceSize uint64        `json:"device_size"`
+	SectorSize uint64        `json:"sector_size"`
+	Ranges     []backupRange `json:"ranges"`
+}
+
+// Backup writes to the file at location a compressed copy of the partition
+// table structures and the partitions of the device. Unpartitioned space
+// is skipped.
+func Backup(location string, deviceName string) error {
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	sectorSize, _, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDONLY)
+	if err != nil {
+		return fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	table, err := readDevicePartitions(dev, sectorSize)
+	if err != nil {
+		return err
+	}
+
+	regions, err := planLayout(table, deviceSize, PartitionPolicy{})
+	if err != nil {
+		return fmt.Errorf("Invalid partition table on %s: %s", deviceName, err.Error())
+	}
+
+	header := backupHeader{DeviceSize: deviceSize, SectorSize: sectorSize}
+	for _, r := range regions {
+		if r.Kind != regionZero && r.Sectors > 0 {
+			header.Ranges = append(header.Ranges, backupRange{FirstLBA: r.FirstLBA, Sectors: r.Sectors})
+		}
+	}
+
+	file, err := os.Create(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffered := bufio.NewWriter(file)
+	compressed := gzip.NewWriter(buffered)
+
+	data, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+
+	if _, err := compressed.Write([]byte(backupMagic)); err != nil {
+		return err
+	}
+
+	if err := binary.Write(compressed, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+
+	if _, err := compressed.Write(data); err != nil {
+		return err
+	}
+
+	for _, r := range header.Ranges {
+		log.Printf("Backing up sectors %d to %d\n", r.FirstLBA, r.FirstLBA+r.Sectors-1)
+
+		checksum := sha256.New()
+		if err := copySectors(dev, io.MultiWriter(compressed, checksum), sectorSize, r.FirstLBA, r.Sectors); err != nil {
+			return fmt.Errorf("Failed to read sectors %d to %d: %s", r.FirstLBA, r.FirstLBA+r.Sectors-1, err.Error())
+		}
+
+		if _, err := compressed.Write(checksum.Sum(nil)); err != nil {
+			return err
+		}
+	}
+
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// validate checks that the sector size is usable and that the ranges fit
+// in the device
+func (header *backupHeader) validate() error {
+	sectorSize := header.SectorSize
+	if sectorSize < 512 || sectorSize > backupBufferSize || sectorSize&(sectorSize-1) != 0 {
+		return fmt.Errorf("Invalid sector size %d", sectorSize)
+	}
+
+	sectors := header.DeviceSize / sectorSize
+	for _, r := range header.Ranges {
+		if r.Sectors == 0 || r.FirstLBA+r.Sectors < r.FirstLBA || r.FirstLBA+r.Sectors > sectors {
+			return fmt.Errorf("Invalid range of %d sectors at sector %d", r.Sectors, r.FirstLBA)
+		}
+	}
+
+	return nil
+}
+
+// openBackup opens the backup at location and reads its header
+func openBackup(location string) (*os.File, *gzip.Reader, *backupHeader, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	header, r, err := func() (*backupHeader, *gzip.Reader, error) {
+		r, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		magic := make([]byte, len(backupMagic))
+		if _, err := io.ReadFull(r, magic); err != nil || !bytes.Equal(magic, []byte(backupMagic)) {
+			return nil, nil, errors.New("Not a vlaunch backup")
+		}
+
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, nil, err
+		}
+
+		if size > backupMaxHeaderSize {
+			return nil, nil, fmt.Errorf("Header too large (%d bytes)", size)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, nil, err
+		}
+
+		header := &backupHeader{}
+		if err := json.Unmarshal(data, header); err != nil {
+			return nil, nil, err
+		}
+
+		if err := header.validate(); err != nil {
+			return nil, nil, err
+		}
+
+		return header, r, nil
+	}()
+
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, fmt.Errorf("Failed to read backup %s: %s", location, err.Error())
+	}
+
+	return file, r, header, nil
+}
+
+// readRange reads the data of a range of the backup, passing it by chunks
+// to write, and checks its checksum
+func readRange(r io.Reader, header *backupHeader, rng backupRange, write func([]byte, uint64) error) error {
+	checksum := sha256.New()
+	buffer := make([]byte, backupBufferSize-backupBufferSize%header.SectorSize)
+
+	offset := rng.FirstLBA * header.SectorSize
+	remaining := rng.Sectors * header.SectorSize
+	for remaining > 0 {
+		chunk := buffer
+		if remaining < uint64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return err
+		}
+		checksum.Write(chunk)
+
+		if err := write(chunk, offset); err != nil {
+			return err
+		}
+
+		offset += uint64(len(chunk))
+		remaining -= uint64(len(chunk))
+	}
+
+	return checkSum(r, checksum)
+}
+
+func checkSum(r io.Reader, checksum hash.Hash) error {
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, expected); err != nil {
+		return err
+	}
+
+	if !bytes.Equal(expected, checksum.Sum(nil)) {
+		return errors.New("Checksum mismatch")
+	}
+
+	return nil
+}
+
+// verifyBackup reads the whole backup at location, checks the checksums
+// and returns its header
+func verifyBackup(location string) (*backupHeader, error) {
+	file, r, header, err := openBackup(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	discard := func([]byte, uint64) error { return nil }
+	for _, rng := range header.Ranges {
+		if err := readRange(r, header, rng, discard); err != nil {
+			return nil, fmt.Errorf("Backup of sectors %d to %d is corrupted: %s", rng.FirstLBA, rng.FirstLBA+rng.Sectors-1, err.Error())
+		}
+	}
+
+	return header, nil
+}
+
+// checkRestoreTarget checks that the backup can be written to the device
+func checkRestoreTarget(header *backupHeader, deviceName string) error {
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	sectorSize, _, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case sectorSize != header.SectorSize:
+		return fmt.Errorf("Backup has %d bytes sectors, %s has %d bytes sectors", header.SectorSize, deviceName, sectorSize)
+	case deviceSize < header.DeviceSize:
+		return fmt.Errorf("Backup needs %d bytes, %s only has %d bytes", header.DeviceSize, deviceName, deviceSize)
+	case deviceSize > header.DeviceSize:
+		log.Printf("%s is larger than the backed up device, the backup GPT will not be at the end of the device\n", deviceName)
+	}
+
+	return nil
+}
+
+// VerifyBackup reads the whole backup at location, checks the checksums
+// and that it can be restored to the device
+func VerifyBackup(location string, deviceName string) error {
+	header, err := verifyBackup(location)
+	if err != nil {
+		return err
+	}
+
+	return checkRestoreTarget(header, deviceName)
+}
+
+// Restore writes the backup at location to the device. It must have been
+// checked with VerifyBackup, the checksums of the ranges are checked again
+// as they are written.
+func Restore(location string, deviceName string) error {
+	file, r, header, err := openBackup(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := checkRestoreTarget(header, deviceName); err != nil {
+		return err
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	writeDevice := func(data []byte, offset uint64) error {
+		if _, err := dev.Seek(int64(offset), io.SeekStart); err != nil {
+			return err
+		}
+		_, err := dev.Write(data)
+		return err
+	}
+
+	for _, rng := range header.Ranges {
+		log.Printf("Restoring sectors %d to %d\n", rng.FirstLBA, rng.FirstLBA+rng.Sectors-1)
+		if err := readRange(r, header, rng, writeDevice); err != nil {
+			return fmt.Errorf("Failed to restore sectors %d to %d: %s", rng.FirstLBA, rng.FirstLBA+rng.Sectors-1, err.Error())
+		}
+	}
+
+	return nil
+}
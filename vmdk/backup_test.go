@@ -0,0 +1,63 @@
+package vmdk
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBackupHeaderValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		header backupHeader
+		fails  bool
+	}{
+		{
+			name:   "valid",
+			header: backupHeader{DeviceSize: 2048 * 512, SectorSize: 512, Ranges: []backupRange{{FirstLBA: 0, Sectors: 34}, {FirstLBA: 34, Sectors: 2014}}},
+		},
+		{
+			name:   "4K sectors",
+			header: backupHeader{DeviceSize: 256 * 4096, SectorSize: 4096, Ranges: []backupRange{{FirstLBA: 0, Sectors: 256}}},
+		},
+		{
+			name:   "no sector size",
+			header: backupHeader{DeviceSize: 2048 * 512, Ranges: []backupRange{{FirstLBA: 0, Sectors: 34}}},
+			fails:  true,
+		},
+		{
+			name:   "sector size not a power of two",
+			header: backupHeader{DeviceSize: 2048 * 768, SectorSize: 768},
+			fails:  true,
+		},
+		{
+			name:   "sector size larger than the buffer",
+			header: backupHeader{DeviceSize: 4 * backupBufferSize, SectorSize: 2 * backupBufferSize},
+			fails:  true,
+		},
+		{
+			name:   "empty range",
+			header: backupHeader{DeviceSize: 2048 * 512, SectorSize: 512, Ranges: []backupRange{{FirstLBA: 34, Sectors: 0}}},
+			fails:  true,
+		},
+		{
+			name:   "range past the end of the device",
+			header: backupHeader{DeviceSize: 2048 * 512, SectorSize: 512, Ranges: []backupRange{{FirstLBA: 2000, Sectors: 49}}},
+			fails:  true,
+		},
+		{
+			name:   "overflowing range",
+			header: backupHeader{DeviceSize: 2048 * 512, SectorSize: 512, Ranges: []backupRange{{FirstLBA: math.MaxUint64, Sectors: 2}}},
+			fails:  true,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.header.validate()
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s: expected an error", test.name)
+		case !test.fails && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		}
+	}
+}
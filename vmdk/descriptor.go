@@ -0,0 +1,168 @@
+package vmdk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// parseDescriptor parses a VMDK text descriptor
+func parseDescriptor(r io.Reader) (*rawVMDK, error) {
+	vmdk := &rawVMDK{DDB: make(map[string]string)}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "RW ") || strings.HasPrefix(line, "RDONLY ") || strings.HasPrefix(line, "NOACCESS "):
+			extent, err := parseExtent(line)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %s", lineNumber, err.Error())
+			}
+			vmdk.Extents = append(vmdk.Extents, *extent)
+		case strings.Contains(line, "="):
+			parts := strings.SplitN(line, "=", 2)
+			key := strings.TrimSpace(parts[0])
+			value := strings.Trim(strings.TrimSpace(parts[1]), "\"")
+
+			if strings.HasPrefix(key, "ddb.") {
+				vmdk.DDB[strings.TrimPrefix(key, "ddb.")] = value
+			} else if key == "createType" {
+				vmdk.Type = value
+			} else if key == "CID" {
+				vmdk.CID = value
+			}
+		default:
+			return nil, fmt.Errorf("Line %d: unexpected content '%s'", lineNumber, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if vmdk.Type == "" {
+		return nil, fmt.Errorf("Missing createType")
+	}
+
+	if value, found := vmdk.DDB["uuid.image"]; found {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid image UUID '%s': %s", value, err.Error())
+		}
+		vmdk.UUID = id
+	}
+
+	if value, found := vmdk.DDB["uuid.modification"]; found {
+		vmdk.ModificationUUID, _ = uuid.Parse(value)
+	}
+
+	vmdk.AdapterType = vmdk.DDB["adapterType"]
+	vmdk.Geometry.Cylinders, _ = strconv.ParseUint(vmdk.DDB["geometry.cylinders"], 10, 64)
+	vmdk.Geometry.Heads, _ = strconv.ParseUint(vmdk.DDB["geometry.heads"], 10, 64)
+	vmdk.Geometry.Sectors, _ = strconv.ParseUint(vmdk.DDB["geometry.sectors"], 10, 64)
+
+	vmdk.LogicalSectorSize = descriptorSectorSize
+	if value, found := vmdk.DDB["logicalSectorSize"]; found {
+		vmdk.LogicalSectorSize, _ = strconv.ParseUint(value, 10, 64)
+	}
+
+	vmdk.PhysicalSectorSize = vmdk.LogicalSectorSize
+	if value, found := vmdk.DDB["physicalSectorSize"]; found {
+		vmdk.PhysicalSectorSize, _ = strconv.ParseUint(value, 10, 64)
+	}
+
+	return vmdk, nil
+}
+
+// parseExtent parses an extent line such as
+// RW 2048 FLAT "raw-pt.vmdk" 0. FLAT, SPARSE and ZERO extents are supported.
+func parseExtent(line string) (*extent, error) {
+	var path string
+	if start := strings.Index(line, "\""); start != -1 {
+		end := strings.LastIndex(line, "\"")
+		if end == start {
+			return nil, fmt.Errorf("Unterminated extent path")
+		}
+		path = line[start+1 : end]
+		line = line[:start] + line[end+1:]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("Invalid extent '%s'", line)
+	}
+
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil || size == 0 {
+		return nil, fmt.Errorf("Invalid extent size '%s'", fields[1])
+	}
+
+	e := &extent{AccessMode: fields[0], Size: size, Type: fields[2], Path: path}
+	switch e.Type {
+	case "FLAT":
+		if path == "" {
+			return nil, fmt.Errorf("Missing path for FLAT extent")
+		}
+
+		if len(fields) > 3 {
+			if e.Offset, err = strconv.ParseUint(fields[3], 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid extent offset '%s'", fields[3])
+			}
+		}
+	case "SPARSE":
+		if path == "" {
+			return nil, fmt.Errorf("Missing path for SPARSE extent")
+		}
+	case "ZERO":
+	default:
+		return nil, fmt.Errorf("Unsupported extent type '%s'", e.Type)
+	}
+
+	return e, nil
+}
+
+// readDescriptor parses the descriptor at location, or the descriptor
+// embedded in the sparse extent at location
+func readDescriptor(location string) (*rawVMDK, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	var header sparseExtentHeader
+	if err := binary.Read(file, binary.LittleEndian, &header); err == nil && header.MagicNumber == sparseMagic {
+		// The descriptor of sparse extents is embedded after the header
+		if header.DescriptorSize == 0 || header.DescriptorSize > 2048 {
+			return nil, fmt.Errorf("Invalid descriptor size %d in %s", header.DescriptorSize, location)
+		}
+		descriptor := make([]byte, header.DescriptorSize*descriptorSectorSize)
+		if _, err := file.ReadAt(descriptor, int64(header.DescriptorOffset*descriptorSectorSize)); err != nil {
+			return nil, fmt.Errorf("Failed to read the descriptor of %s: %s", location, err.Error())
+		}
+		r = bytes.NewReader(bytes.TrimRight(descriptor, "\x00"))
+	} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	vmdk, err := parseDescriptor(r)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %s", location, err.Error())
+	}
+
+	vmdk.TargetPath = location
+	return vmdk, nil
+}
@@ -0,0 +1,164 @@
+package vmdk
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDescriptorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		vmdk       rawVMDK
+		out        OutputOptions
+		sectorSize uint64
+	}{
+		{
+			name: "full device",
+			vmdk: rawVMDK{
+				Type:       "fullDevice",
+				DeviceSize: 2048 * 512,
+				Extents:    []extent{{AccessMode: "RW", Size: 2048, Type: "FLAT", Path: "/dev/sdb"}},
+			},
+			sectorSize: 512,
+		},
+		{
+			name: "partitions",
+			vmdk: rawVMDK{
+				Type:       "partitionedDevice",
+				DeviceSize: 2048 * 512,
+				Extents: []extent{
+					{AccessMode: "RW", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+					{AccessMode: "RDONLY", Size: 966, Type: "FLAT", Path: "/dev/sdb", Offset: 34},
+					{AccessMode: "RDONLY", Size: 1048, Type: "ZERO"},
+				},
+			},
+			sectorSize: 512,
+		},
+		{
+			name: "sparse extent",
+			vmdk: rawVMDK{
+				Type:       "monolithicSparse",
+				DeviceSize: 4096 * 512,
+				Extents:    []extent{{AccessMode: "RW", Size: 4096, Type: "SPARSE", Path: "disk.vmdk"}},
+			},
+			sectorSize: 512,
+		},
+		{
+			name: "4K sectors",
+			vmdk: rawVMDK{
+				Type:       "fullDevice",
+				DeviceSize: 2048 * 512,
+				Extents:    []extent{{AccessMode: "RW", Size: 2048, Type: "FLAT", Path: "/dev/sdb"}},
+			},
+			sectorSize: 4096,
+		},
+		{
+			name: "VMware",
+			vmdk: rawVMDK{
+				Type:       "fullDevice",
+				DeviceSize: 2048 * 512,
+				Extents:    []extent{{AccessMode: "RW", Size: 2048, Type: "FLAT", Path: "/dev/sdb"}},
+			},
+			out:        OutputOptions{Format: FormatVMware, AdapterType: AdapterLSILogic},
+			sectorSize: 512,
+		},
+	}
+
+	for _, test := range tests {
+		vmdk := test.vmdk
+		vmdk.UUID = uuid.New()
+		vmdk.LogicalSectorSize = test.sectorSize
+		vmdk.PhysicalSectorSize = test.sectorSize
+
+		var descriptor bytes.Buffer
+		if err := vmdk.render(&descriptor, test.out); err != nil {
+			t.Errorf("%s: failed to render: %s", test.name, err.Error())
+			continue
+		}
+
+		parsed, err := parseDescriptor(&descriptor)
+		if err != nil {
+			t.Errorf("%s: failed to parse: %s", test.name, err.Error())
+			continue
+		}
+
+		if parsed.Type != vmdk.Type || parsed.CID != vmdk.CID || parsed.UUID != vmdk.UUID || parsed.ModificationUUID != vmdk.ModificationUUID {
+			t.Errorf("%s: expected %s %s %s %s, got %s %s %s %s", test.name,
+				vmdk.Type, vmdk.CID, vmdk.UUID, vmdk.ModificationUUID,
+				parsed.Type, parsed.CID, parsed.UUID, parsed.ModificationUUID)
+		}
+		if !reflect.DeepEqual(parsed.Extents, vmdk.Extents) {
+			t.Errorf("%s: expected extents %+v, got %+v", test.name, vmdk.Extents, parsed.Extents)
+		}
+		if parsed.AdapterType != vmdk.AdapterType || parsed.Geometry != vmdk.Geometry {
+			t.Errorf("%s: expected %s %+v, got %s %+v", test.name, vmdk.AdapterType, vmdk.Geometry, parsed.AdapterType, parsed.Geometry)
+		}
+		if parsed.LogicalSectorSize != test.sectorSize || parsed.PhysicalSectorSize != test.sectorSize {
+			t.Errorf("%s: expected %d bytes sectors, got %d/%d", test.name, test.sectorSize, parsed.LogicalSectorSize, parsed.PhysicalSectorSize)
+		}
+	}
+}
+
+func TestParseExtent(t *testing.T) {
+	tests := []struct {
+		line   string
+		extent extent
+		fails  bool
+	}{
+		{line: `RW 2048 FLAT "/dev/sdb" 0`, extent: extent{AccessMode: "RW", Size: 2048, Type: "FLAT", Path: "/dev/sdb"}},
+		{line: `RDONLY 966 FLAT "my disk.img" 34`, extent: extent{AccessMode: "RDONLY", Size: 966, Type: "FLAT", Path: "my disk.img", Offset: 34}},
+		{line: `RW 4096 SPARSE "disk.vmdk"`, extent: extent{AccessMode: "RW", Size: 4096, Type: "SPARSE", Path: "disk.vmdk"}},
+		{line: `RW 1048 ZERO`, extent: extent{AccessMode: "RW", Size: 1048, Type: "ZERO"}},
+		{line: `RW 2048 FLAT`, fails: true},
+		{line: `RW 4096 SPARSE`, fails: true},
+		{line: `RW 0 ZERO`, fails: true},
+		{line: `RW 2048 FLAT "/dev/sdb" x`, fails: true},
+		{line: `RW 2048 VMFS "disk.vmdk"`, fails: true},
+		{line: `RW 2048 FLAT "/dev/sdb`, fails: true},
+	}
+
+	for _, test := range tests {
+		e, err := parseExtent(test.line)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s: expected an error, got %+v", test.line, *e)
+		case !test.fails && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.line, err.Error())
+		case !test.fails && *e != test.extent:
+			t.Errorf("%s: expected %+v, got %+v", test.line, test.extent, *e)
+		}
+	}
+}
+
+func TestReadSparseDescriptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vlaunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "disk.vmdk")
+	w, err := createSparseVMDK(location, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	vmdk, err := readDescriptor(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []extent{{AccessMode: "RW", Size: 2048, Type: "SPARSE", Path: "disk.vmdk"}}
+	if vmdk.Type != "monolithicSparse" || !reflect.DeepEqual(vmdk.Extents, expected) {
+		t.Errorf("expected monolithicSparse %+v, got %s %+v", expected, vmdk.Type, vmdk.Extents)
+	}
+}
@@ -0,0 +1,275 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// fatMaxDirectorySize bounds the size of the directories read
+const fatMaxDirectorySize = 1024 * 1024
+
+// fatVolume is a read-only view of a FAT12, FAT16 or FAT32 filesystem,
+// enough to look up the files of an EFI system partition
+type fatVolume struct {
+	r           io.ReadSeeker
+	offset      uint64
+	bits        int
+	clusterSize uint64
+	fatOffset   uint64
+	rootOffset  uint64
+	rootSize    uint64
+	rootCluster uint32
+	dataOffset  uint64
+	clusters    uint64
+}
+
+type fatEntry struct {
+	Name    string
+	Dir     bool
+	Cluster uint32
+	Size    uint32
+}
+
+// openFAT reads the boot sector of the FAT filesystem at offset
+func openFAT(r io.ReadSeeker, offset uint64) (*fatVolume, error) {
+	data := make([]byte, 512)
+	if err := readAt(r, data, offset); err != nil {
+		return nil, err
+	}
+
+	bytesPerSector := uint64(binary.LittleEndian.Uint16(data[11:]))
+	sectorsPerCluster := uint64(data[13])
+	reservedSectors := uint64(binary.LittleEndian.Uint16(data[14:]))
+	fats := uint64(data[16])
+	rootEntries := uint64(binary.LittleEndian.Uint16(data[17:]))
+
+	totalSectors := uint64(binary.LittleEndian.Uint16(data[19:]))
+	if totalSectors == 0 {
+		totalSectors = uint64(binary.LittleEndian.Uint32(data[32:]))
+	}
+
+	fatSize := uint64(binary.LittleEndian.Uint16(data[22:]))
+	if fatSize == 0 {
+		fatSize = uint64(binary.LittleEndian.Uint32(data[36:]))
+	}
+
+	if bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 ||
+		sectorsPerCluster == 0 || sectorsPerCluster&(sectorsPerCluster-1) != 0 ||
+		fats == 0 || fatSize == 0 {
+		return nil, errors.New("Invalid FAT boot sector")
+	}
+
+	rootSectors := (rootEntries*32 + bytesPerSector - 1) / bytesPerSector
+	dataSector := reservedSectors + fats*fatSize + rootSectors
+	if totalSectors <= dataSector {
+		return nil, errors.New("Invalid FAT boot sector")
+	}
+
+	vol := &fatVolume{
+		r:           r,
+		offset:      offset,
+		clusterSize: sectorsPerCluster * bytesPerSector,
+		fatOffset:   reservedSectors * bytesPerSector,
+		rootOffset:  (reservedSectors + fats*fatSize) * bytesPerSector,
+		rootSize:    rootSectors * bytesPerSector,
+		dataOffset:  dataSector * bytesPerSector,
+		clusters:    (totalSectors - dataSector) / sectorsPerCluster,
+	}
+
+	switch {
+	case vol.clusters < 4085:
+		vol.bits = 12
+	case vol.clusters < 65525:
+		vol.bits = 16
+	default:
+		vol.bits = 32
+		vol.rootCluster = binary.LittleEndian.Uint32(data[44:])
+	}
+
+	return vol, nil
+}
+
+// next returns the cluster following cluster in its chain, or 0 at the
+// end of the chain
+func (vol *fatVolume) next(cluster uint32) (uint32, error) {
+	data := make([]byte, 4)
+	var value, end uint32
+	switch vol.bits {
+	case 12:
+		if err := readAt(vol.r, data[:2], vol.offset+vol.fatOffset+uint64(cluster)*3/2); err != nil {
+			return 0, err
+		}
+		if value = uint32(binary.LittleEndian.Uint16(data)); cluster&1 == 1 {
+			value >>= 4
+		}
+		value, end = value&0xfff, 0xff8
+	case 16:
+		if err := readAt(vol.r, data[:2], vol.offset+vol.fatOffset+uint64(cluster)*2); err != nil {
+			return 0, err
+		}
+		value, end = uint32(binary.LittleEndian.Uint16(data)), 0xfff8
+	default:
+		if err := readAt(vol.r, data, vol.offset+vol.fatOffset+uint64(cluster)*4); err != nil {
+			return 0, err
+		}
+		value, end = binary.LittleEndian.Uint32(data)&0x0fffffff, 0x0ffffff8
+	}
+
+	if value >= end {
+		return 0, nil
+	}
+	return value, nil
+}
+
+// readChain reads at most limit bytes of the cluster chain starting at
+// cluster
+func (vol *fatVolume) readChain(cluster uint32, limit uint64) ([]byte, error) {
+	var data []byte
+	for count := uint64(0); cluster != 0 && uint64(len(data)) < limit; count++ {
+		if cluster < 2 || uint64(cluster) >= vol.clusters+2 || count > vol.clusters {
+			return nil, fmt.Errorf("Invalid FAT cluster chain at cluster %d", cluster)
+		}
+
+		buffer := make([]byte, vol.clusterSize)
+		if err := readAt(vol.r, buffer, vol.offset+vol.dataOffset+uint64(cluster-2)*vol.clusterSize); err != nil {
+			return nil, err
+		}
+		data = append(data, buffer...)
+
+		next, err := vol.next(cluster)
+		if err != nil {
+			return nil, err
+		}
+		cluster = next
+	}
+
+	if uint64(len(data)) > limit {
+		data = data[:limit]
+	}
+	return data, nil
+}
+
+// list returns the entries of the directory, or of the root directory if
+// dir is nil
+func (vol *fatVolume) list(dir *fatEntry) ([]fatEntry, error) {
+	var data []byte
+	var err error
+	switch {
+	case dir != nil:
+		data, err = vol.readChain(dir.Cluster, fatMaxDirectorySize)
+	case vol.bits == 32:
+		data, err = vol.readChain(vol.rootCluster, fatMaxDirectorySize)
+	default:
+		data = make([]byte, vol.rootSize)
+		err = readAt(vol.r, data, vol.offset+vol.rootOffset)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []fatEntry
+	var longName []uint16
+	for i := 0; i+32 <= len(data); i += 32 {
+		raw := data[i : i+32]
+		attributes := raw[11]
+		switch {
+		case raw[0] == 0:
+			return entries, nil
+		case raw[0] == 0xe5:
+			longName = nil
+			continue
+		case attributes == 0x0f:
+			// Long name entries come last part first, 13 characters each
+			var part []uint16
+			for _, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				part = append(part, binary.LittleEndian.Uint16(raw[offset:]))
+			}
+			if raw[0]&0x40 != 0 {
+				longName = nil
+			}
+			longName = append(part, longName...)
+			continue
+		case attributes&0x08 != 0:
+			longName = nil
+			continue
+		}
+
+		entry := fatEntry{
+			Dir:     attributes&0x10 != 0,
+			Cluster: uint32(binary.LittleEndian.Uint16(raw[20:]))<<16 | uint32(binary.LittleEndian.Uint16(raw[26:])),
+			Size:    binary.LittleEndian.Uint32(raw[28:]),
+		}
+
+		if longName != nil {
+			for end, c := range longName {
+				if c == 0 || c == 0xffff {
+					longName = longName[:end]
+					break
+				}
+			}
+			entry.Name = string(utf16.Decode(longName))
+		} else {
+			entry.Name = strings.TrimRight(string(raw[:8]), " ")
+			if ext := strings.TrimRight(string(raw[8:11]), " "); ext != "" {
+				entry.Name += "." + ext
+			}
+		}
+		longName = nil
+
+		if entry.Name != "." && entry.Name != ".." {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// lookup returns the entry at path, given as its components, whatever
+// their case, or nil if there is none
+func (vol *fatVolume) lookup(path ...string) (*fatEntry, error) {
+	var dir *fatEntry
+	for _, name := range path {
+		if dir != nil && !dir.Dir {
+			return nil, nil
+		}
+
+		entries, err := vol.list(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		var found *fatEntry
+		for i := range entries {
+			if strings.EqualFold(entries[i].Name, name) {
+				found = &entries[i]
+				break
+			}
+		}
+
+		if found == nil {
+			return nil, nil
+		}
+		dir = found
+	}
+	return dir, nil
+}
+
+// read returns at most the first limit bytes of the file
+func (vol *fatVolume) read(file *fatEntry, limit uint64) ([]byte, error) {
+	if uint64(file.Size) < limit {
+		limit = uint64(file.Size)
+	}
+	return vol.readChain(file.Cluster, limit)
+}
+
+func readAt(r io.ReadSeeker, data []byte, offset uint64) error {
+	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(r, data)
+	return err
+}
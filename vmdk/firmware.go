@@ -0,0 +1,53 @@
+package vmdk
+
+import (
+	"strings"
+)
+
+// Firmware types of the virtual machine
+const (
+	FirmwareBIOS = "bios"
+	FirmwareEFI  = "efi"
+)
+
+const (
+	// efiSystemGUID is the GPT type of EFI system partitions
+	efiSystemGUID = "C12A7328-F81F-11D2-BA4B-00A0C93EC93B"
+	// biosBootGUID is the GPT type of the partitions holding the BIOS
+	// stage of GRUB
+	biosBootGUID = "21686148-6449-6E6F-744E-656564454649"
+	// mbrEFISystemType is the MBR type of EFI system partitions
+	mbrEFISystemType = 0xef
+)
+
+// firmware returns the firmware the disk is meant to be booted with. EFI
+// is only chosen when there is an EFI system partition and nothing that
+// could be booted by a BIOS.
+func (table *partitionTable) firmware() string {
+	hasESP := false
+	for _, part := range table.Partitions {
+		switch {
+		case part.Bootable, strings.EqualFold(part.TypeGUID, biosBootGUID):
+			return FirmwareBIOS
+		case part.Type == mbrEFISystemType, strings.EqualFold(part.TypeGUID, efiSystemGUID):
+			hasESP = true
+		}
+	}
+
+	if hasESP {
+		return FirmwareEFI
+	}
+	return FirmwareBIOS
+}
+
+// DetectFirmware returns the firmware needed to boot the device, disk image
+// or VDI at location, according to its partition table
+func DetectFirmware(location string) (string, error) {
+	_, table, closer, err := openDisk(location)
+	if err != nil {
+		return "", err
+	}
+	closer.Close()
+
+	return table.firmware(), nil
+}
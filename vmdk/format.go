@@ -0,0 +1,229 @@
+package vmdk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Descriptor formats
+const (
+	FormatVirtualBox = "virtualbox"
+	FormatVMware     = "vmware"
+	FormatQEMU       = "qemu"
+)
+
+// Adapter types of the virtual disk controller
+const (
+	AdapterIDE      = "ide"
+	AdapterLSILogic = "lsilogic"
+	AdapterBusLogic = "buslogic"
+	AdapterPVSCSI   = "pvscsi"
+)
+
+// zeroDevice backs the unallocated regions of QEMU descriptors
+const zeroDevice = "/dev/zero"
+
+// OutputOptions controls the flavor of the written descriptor
+type OutputOptions struct {
+	// Format is the hypervisor the descriptor is written for, VirtualBox
+	// if not set. The QEMU format also writes a JSON blockdev description
+	// next to the descriptor.
+	Format string
+	// AdapterType is the controller the disk is attached to, IDE if not set
+	AdapterType string
+}
+
+// geometry is a cylinders, heads, sectors geometry
+type geometry struct {
+	Cylinders uint64
+	Heads     uint64
+	Sectors   uint64
+}
+
+// diskGeometry returns the physical geometry of a disk of size bytes
+// attached to a controller of the adapter type, as computed by VMware
+func diskGeometry(size uint64, adapterType string) geometry {
+	g := geometry{Heads: 16, Sectors: 63}
+	if adapterType != AdapterIDE {
+		switch {
+		case size < 1<<30:
+			g = geometry{Heads: 64, Sectors: 32}
+		case size < 2<<30:
+			g = geometry{Heads: 128, Sectors: 32}
+		default:
+			g = geometry{Heads: 255, Sectors: 63}
+		}
+	}
+
+	g.Cylinders = size / descriptorSectorSize / (g.Heads * g.Sectors)
+	if adapterType == AdapterIDE && g.Cylinders > 16383 {
+		g.Cylinders = 16383
+	}
+	return g
+}
+
+// biosGeometry returns the geometry seen by the BIOS with LBA-assisted
+// translation, limited to 1024 cylinders
+func biosGeometry(size uint64) geometry {
+	sectors := size / descriptorSectorSize
+	g := geometry{Heads: 16, Sectors: 63}
+	for g.Heads < 255 && sectors/(g.Heads*g.Sectors) > 1024 {
+		if g.Heads *= 2; g.Heads > 255 {
+			g.Heads = 255
+		}
+	}
+
+	g.Cylinders = sectors / (g.Heads * g.Sectors)
+	if g.Cylinders > 1024 {
+		g.Cylinders = 1024
+	}
+	return g
+}
+
+// setOutput sets the fields of the descriptor that depend on the format
+func (vmdk *rawVMDK) setOutput(out OutputOptions) error {
+	adapterType := out.AdapterType
+	switch adapterType {
+	case "":
+		adapterType = AdapterIDE
+	case AdapterIDE, AdapterLSILogic, AdapterBusLogic, AdapterPVSCSI:
+	default:
+		return fmt.Errorf("Invalid adapter type '%s'", adapterType)
+	}
+
+	vmdk.AdapterType = adapterType
+	vmdk.HWVersion = "4"
+
+	switch out.Format {
+	case "", FormatVirtualBox:
+		// VirtualBox ignores the adapter type and always uses this geometry
+		vmdk.Geometry = diskGeometry(vmdk.DeviceSize, AdapterIDE)
+		vmdk.BIOSGeometry = vmdk.Geometry
+	case FormatVMware, FormatQEMU:
+		vmdk.Geometry = diskGeometry(vmdk.DeviceSize, adapterType)
+		vmdk.BIOSGeometry = biosGeometry(vmdk.DeviceSize)
+		if adapterType == AdapterPVSCSI {
+			vmdk.HWVersion = "7"
+		}
+
+		if out.Format == FormatVMware {
+			vmdk.Encoding = "UTF-8"
+		} else {
+			// QEMU refuses the device types but handles flat extents
+			// on any kind of file
+			vmdk.Type = "monolithicFlat"
+			if err := vmdk.setQEMUExtents(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Invalid descriptor format '%s'", out.Format)
+	}
+
+	return nil
+}
+
+// setQEMUExtents rewrites the extents for QEMU, which skips the extents
+// that are not FLAT or SPARSE or not read-write and maps the next ones at
+// the offsets of the skipped ones. ZERO extents are mapped onto zeroDevice,
+// and a read-only disk is made read-only in the blockdev description.
+func (vmdk *rawVMDK) setQEMUExtents() error {
+	var flat, readOnly int
+	for _, e := range vmdk.Extents {
+		if e.Type != "ZERO" {
+			flat++
+			if e.AccessMode == "RDONLY" {
+				readOnly++
+			}
+		}
+	}
+
+	if readOnly != 0 && readOnly != flat {
+		return errors.New("QEMU cannot expose only some partitions read-only, hide them or make the whole disk read-only")
+	}
+	vmdk.readOnly = readOnly != 0
+
+	for i, e := range vmdk.Extents {
+		if e.Type == "ZERO" {
+			if _, err := os.Stat(zeroDevice); err != nil {
+				return fmt.Errorf("QEMU cannot map the unallocated regions of the disk without %s", zeroDevice)
+			}
+			e.Type, e.Path, e.Offset = "FLAT", zeroDevice, 0
+		}
+		e.AccessMode = "RW"
+		vmdk.Extents[i] = e
+	}
+
+	return nil
+}
+
+// blockdevLocation returns the location of the QEMU blockdev description
+// of the descriptor at location
+func blockdevLocation(location string) string {
+	return strings.TrimSuffix(location, path.Ext(location)) + ".json"
+}
+
+type blockdevFile struct {
+	Driver   string `json:"driver"`
+	Filename string `json:"filename"`
+	ReadOnly bool   `json:"read-only,omitempty"`
+}
+
+type blockdev struct {
+	Driver   string         `json:"driver"`
+	NodeName string         `json:"node-name"`
+	ReadOnly bool           `json:"read-only,omitempty"`
+	File     blockdevFile   `json:"file"`
+	Extents  []blockdevFile `json:"extents,omitempty"`
+}
+
+// writeBlockdev writes the QEMU blockdev description of the descriptor at
+// location, to be used with -blockdev. The files of the extents are given
+// explicitly so that devices are opened with the right driver.
+func (vmdk *rawVMDK) writeBlockdev(location string) error {
+	descriptorPath, err := filepath.Abs(location)
+	if err != nil {
+		return err
+	}
+
+	description := blockdev{
+		Driver:   "vmdk",
+		NodeName: "vlaunch-disk",
+		ReadOnly: vmdk.readOnly,
+		File:     blockdevFile{Driver: "file", Filename: descriptorPath, ReadOnly: vmdk.readOnly},
+	}
+
+	// setQEMUExtents made all the extents FLAT, so that their numbering
+	// matches the one of QEMU
+	for _, e := range vmdk.Extents {
+		filename := e.Path
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(filepath.Dir(descriptorPath), filename)
+		}
+
+		file := blockdevFile{Driver: "file", Filename: filename, ReadOnly: vmdk.readOnly}
+		if fi, err := os.Stat(filename); err == nil && !fi.Mode().IsRegular() {
+			file.Driver = "host_device"
+		}
+		description.Extents = append(description.Extents, file)
+	}
+
+	data, err := json.MarshalIndent(description, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(blockdevLocation(location))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,163 @@
+package vmdk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskGeometry(t *testing.T) {
+	tests := []struct {
+		name        string
+		size        uint64
+		adapterType string
+		geometry    geometry
+	}{
+		{name: "IDE", size: 1 << 20, adapterType: AdapterIDE, geometry: geometry{Cylinders: 2, Heads: 16, Sectors: 63}},
+		{name: "IDE cylinders limit", size: 100 << 30, adapterType: AdapterIDE, geometry: geometry{Cylinders: 16383, Heads: 16, Sectors: 63}},
+		{name: "SCSI below 1 GB", size: 512 << 20, adapterType: AdapterLSILogic, geometry: geometry{Cylinders: 512, Heads: 64, Sectors: 32}},
+		{name: "SCSI below 2 GB", size: 1536 << 20, adapterType: AdapterBusLogic, geometry: geometry{Cylinders: 768, Heads: 128, Sectors: 32}},
+		{name: "SCSI above 2 GB", size: 100 << 30, adapterType: AdapterPVSCSI, geometry: geometry{Cylinders: 13054, Heads: 255, Sectors: 63}},
+	}
+
+	for _, test := range tests {
+		if g := diskGeometry(test.size, test.adapterType); g != test.geometry {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.geometry, g)
+		}
+	}
+}
+
+func TestBIOSGeometry(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     uint64
+		geometry geometry
+	}{
+		{name: "small disk", size: 1 << 20, geometry: geometry{Cylinders: 2, Heads: 16, Sectors: 63}},
+		{name: "1024 cylinders of 16 heads", size: 1024 * 16 * 63 * 512, geometry: geometry{Cylinders: 1024, Heads: 16, Sectors: 63}},
+		{name: "doubled heads", size: 1 << 30, geometry: geometry{Cylinders: 520, Heads: 64, Sectors: 63}},
+		{name: "255 heads", size: 4 << 30, geometry: geometry{Cylinders: 522, Heads: 255, Sectors: 63}},
+		{name: "cylinders limit", size: 100 << 30, geometry: geometry{Cylinders: 1024, Heads: 255, Sectors: 63}},
+	}
+
+	for _, test := range tests {
+		if g := biosGeometry(test.size); g != test.geometry {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.geometry, g)
+		}
+	}
+}
+
+func TestSetQEMUExtents(t *testing.T) {
+	if _, err := os.Stat(zeroDevice); err != nil {
+		t.Skipf("%s is not available", zeroDevice)
+	}
+
+	tests := []struct {
+		name     string
+		extents  []extent
+		expected []extent
+		readOnly bool
+		fails    bool
+	}{
+		{
+			name: "read-write",
+			extents: []extent{
+				{AccessMode: "RW", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+				{AccessMode: "RW", Size: 966, Type: "FLAT", Path: "/dev/sdb", Offset: 34},
+				{AccessMode: "RDONLY", Size: 1048, Type: "ZERO"},
+			},
+			expected: []extent{
+				{AccessMode: "RW", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+				{AccessMode: "RW", Size: 966, Type: "FLAT", Path: "/dev/sdb", Offset: 34},
+				{AccessMode: "RW", Size: 1048, Type: "FLAT", Path: zeroDevice},
+			},
+		},
+		{
+			name: "read-only",
+			extents: []extent{
+				{AccessMode: "RDONLY", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+				{AccessMode: "RW", Size: 966, Type: "ZERO"},
+				{AccessMode: "RDONLY", Size: 1048, Type: "FLAT", Path: "/dev/sdb", Offset: 1000},
+			},
+			expected: []extent{
+				{AccessMode: "RW", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+				{AccessMode: "RW", Size: 966, Type: "FLAT", Path: zeroDevice},
+				{AccessMode: "RW", Size: 1048, Type: "FLAT", Path: "/dev/sdb", Offset: 1000},
+			},
+			readOnly: true,
+		},
+		{
+			name: "mixed read-only and read-write",
+			extents: []extent{
+				{AccessMode: "RW", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+				{AccessMode: "RDONLY", Size: 2014, Type: "FLAT", Path: "/dev/sdb", Offset: 34},
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		vmdk := rawVMDK{Extents: test.extents}
+		err := vmdk.setQEMUExtents()
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s: expected an error, got %+v", test.name, vmdk.Extents)
+		case !test.fails && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		case !test.fails && (!reflect.DeepEqual(vmdk.Extents, test.expected) || vmdk.readOnly != test.readOnly):
+			t.Errorf("%s: expected %+v read-only %t, got %+v read-only %t", test.name, test.expected, test.readOnly, vmdk.Extents, vmdk.readOnly)
+		}
+	}
+}
+
+func TestWriteBlockdev(t *testing.T) {
+	if _, err := os.Stat(zeroDevice); err != nil {
+		t.Skipf("%s is not available", zeroDevice)
+	}
+
+	dir, err := ioutil.TempDir("", "vlaunch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	location := filepath.Join(dir, "disk.vmdk")
+	vmdk := rawVMDK{
+		Extents: []extent{
+			{AccessMode: "RW", Size: 34, Type: "FLAT", Path: "disk-pt.vmdk"},
+			{AccessMode: "RW", Size: 2014, Type: "FLAT", Path: zeroDevice},
+		},
+		readOnly: true,
+	}
+
+	if err := vmdk.writeBlockdev(location); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(blockdevLocation(location))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var description blockdev
+	if err := json.Unmarshal(data, &description); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := blockdev{
+		Driver:   "vmdk",
+		NodeName: "vlaunch-disk",
+		ReadOnly: true,
+		File:     blockdevFile{Driver: "file", Filename: location, ReadOnly: true},
+		Extents: []blockdevFile{
+			{Driver: "file", Filename: filepath.Join(dir, "disk-pt.vmdk"), ReadOnly: true},
+			{Driver: "host_device", Filename: zeroDevice, ReadOnly: true},
+		},
+	}
+	if !reflect.DeepEqual(description, expected) {
+		t.Errorf("expected %+v, got %+v", expected, description)
+	}
+}
@@ -0,0 +1,191 @@
+package vmdk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// SyncHeader writes back to the device the sectors of the partition table
+// header the guest modified in the copy referenced by the raw VMDK at
+// location. The modified header must still hold a valid partition table
+// that fits in the device. The copies of the backup GPT and of the
+// extended boot records, if any, are synced as well.
+func SyncHeader(location string, deviceName string) error {
+	header, err := ioutil.ReadFile(headerLocation(location))
+	if err != nil {
+		return err
+	}
+
+	sectorSize, _, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	if len(header) == 0 || uint64(len(header))%sectorSize != 0 {
+		return fmt.Errorf("Invalid header size %d", len(header))
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	current, err := readSectors(dev, sectorSize, 0, len(header))
+	if err != nil {
+		return fmt.Errorf("Failed to read device header: %s", err.Error())
+	}
+
+	table, err := validateHeader(header, dev, deviceName, sectorSize)
+	if err != nil {
+		return fmt.Errorf("Refusing to write back header: %s", err.Error())
+	}
+
+	if err := writeChangedSectors(dev, deviceName, sectorSize, 0, header, current); err != nil {
+		return err
+	}
+
+	if err := syncTrailer(dev, deviceName, location, table); err != nil {
+		return err
+	}
+
+	return syncEBRs(dev, deviceName, location, table)
+}
+
+func syncTrailer(dev backend.DeviceFile, deviceName string, location string, table *partitionTable) error {
+	sectorSize := table.SectorSize
+	trailer, err := ioutil.ReadFile(trailerLocation(location))
+	if os.IsNotExist(err) || table.BackupLastLBA == 0 {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if uint64(len(trailer)) != (table.BackupLastLBA-table.BackupFirstLBA+1)*sectorSize {
+		return fmt.Errorf("Backup GPT copy does not match the new partition table")
+	}
+
+	if !bytes.HasPrefix(trailer[uint64(len(trailer))-sectorSize:], []byte("EFI PART")) {
+		return fmt.Errorf("Refusing to write back an invalid backup GPT")
+	}
+
+	current, err := readSectors(dev, sectorSize, table.BackupFirstLBA, len(trailer))
+	if err != nil {
+		return fmt.Errorf("Failed to read device backup GPT: %s", err.Error())
+	}
+
+	return writeChangedSectors(dev, deviceName, sectorSize, table.BackupFirstLBA, trailer, current)
+}
+
+func syncEBRs(dev backend.DeviceFile, deviceName string, location string, table *partitionTable) error {
+	sectorSize := table.SectorSize
+	ebrs, err := ioutil.ReadFile(ebrLocation(location))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var offset uint64
+	for _, part := range table.Partitions {
+		if part.EBRLBA == 0 {
+			continue
+		}
+
+		start, end := offset*sectorSize, (offset+part.FirstLBA-part.EBRLBA)*sectorSize
+		if end > uint64(len(ebrs)) {
+			return fmt.Errorf("EBR areas copy does not match the partition table")
+		}
+		ebr := ebrs[start:end]
+		offset += part.FirstLBA - part.EBRLBA
+
+		if ebr[510] != 0x55 || ebr[511] != 0xaa {
+			return fmt.Errorf("Refusing to write back an invalid EBR at sector %d", part.EBRLBA)
+		}
+
+		current, err := readSectors(dev, sectorSize, part.EBRLBA, len(ebr))
+		if err != nil {
+			return fmt.Errorf("Failed to read EBR at sector %d: %s", part.EBRLBA, err.Error())
+		}
+
+		if err := writeChangedSectors(dev, deviceName, sectorSize, part.EBRLBA, ebr, current); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readSectors(dev backend.DeviceFile, sectorSize, first uint64, size int) ([]byte, error) {
+	if _, err := dev.Seek(int64(first*sectorSize), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(dev, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// writeChangedSectors writes to the device the sectors of data that differ
+// from current, both starting at sector first
+func writeChangedSectors(dev backend.DeviceFile, deviceName string, sectorSize, first uint64, data, current []byte) error {
+	sectors := uint64(len(data)) / sectorSize
+	for sector := uint64(0); sector < sectors; {
+		if sectorEqual(data, current, sectorSize, sector) {
+			sector++
+			continue
+		}
+
+		runStart := sector
+		for sector < sectors && !sectorEqual(data, current, sectorSize, sector) {
+			sector++
+		}
+
+		start, end := runStart*sectorSize, sector*sectorSize
+		log.Printf("Writing back sectors %d to %d of %s\n", first+runStart, first+sector-1, deviceName)
+
+		if _, err := dev.Seek(int64(first*sectorSize+start), io.SeekStart); err != nil {
+			return err
+		}
+
+		if _, err := dev.Write(data[start:end]); err != nil {
+			return fmt.Errorf("Failed to write sectors %d to %d: %s", first+runStart, first+sector-1, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func sectorEqual(a, b []byte, sectorSize, sector uint64) bool {
+	start, end := sector*sectorSize, (sector+1)*sectorSize
+	return bytes.Equal(a[start:end], b[start:end])
+}
+
+// validateHeader checks that the header still contains a partition table
+// that can be mapped on the device
+func validateHeader(header []byte, dev backend.DeviceFile, deviceName string, sectorSize uint64) (*partitionTable, error) {
+	table, err := readPartitions(&deviceReader{head: header, dev: dev}, sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid partition table: %s", err.Error())
+	}
+
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := planLayout(table, deviceSize, PartitionPolicy{}); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
@@ -0,0 +1,92 @@
+package vmdk
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// CreateImageVMDK creates at location a descriptor for the whole disk image
+// file at imagePath. The partitions of the image are mapped as FLAT extents
+// of the file, according to the policy of the options.
+func CreateImageVMDK(location string, imagePath string, opts RawOptions) error {
+	imagePath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return err
+	}
+
+	accessMode := "RDONLY"
+	if !opts.ReadOnly {
+		accessMode = "RW"
+	}
+
+	// The image is only read here, the access mode of the extents decides
+	// whether the guest writes to it
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	fi, err := image.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Disk images do not carry their sector size
+	imageSize := uint64(fi.Size())
+	if imageSize == 0 || imageSize%descriptorSectorSize != 0 {
+		return fmt.Errorf("Size of %s (%d) is not a multiple of %d", imagePath, imageSize, descriptorSectorSize)
+	}
+
+	vmdk := rawVMDK{
+		UUID:               opts.UUID,
+		DeviceName:         imagePath,
+		DeviceSize:         imageSize,
+		LogicalSectorSize:  descriptorSectorSize,
+		PhysicalSectorSize: descriptorSectorSize,
+		Type:               "partitionedDevice",
+	}
+
+	var regions []region
+	table, err := readDevicePartitions(image, descriptorSectorSize)
+	if err == nil {
+		if regions, err = planLayout(table, imageSize, opts.Policy); err != nil {
+			return fmt.Errorf("Invalid partition table in %s: %s", imagePath, err.Error())
+		}
+
+		if vmdk.UUID == uuid.Nil && table.DiskGUID != "" {
+			vmdk.UUID = uuid.NewSHA1(uuidNamespace, []byte("gpt:"+table.DiskGUID))
+		}
+	} else {
+		log.Printf("No partition table found in %s, mapping it as a whole: %s\n", imagePath, err.Error())
+		regions = []region{{Kind: regionPartition, Sectors: imageSize / descriptorSectorSize}}
+	}
+
+	if vmdk.UUID == uuid.Nil {
+		vmdk.UUID = uuid.NewSHA1(uuidNamespace, []byte("image:"+imagePath))
+	}
+
+	for _, r := range regions {
+		newExtent := extent{
+			AccessMode: accessMode,
+			Size:       r.Sectors,
+			Type:       "FLAT",
+			Path:       imagePath,
+			Offset:     r.FirstLBA,
+		}
+
+		if r.Kind == regionZero {
+			newExtent = extent{AccessMode: accessMode, Size: r.Sectors, Type: "ZERO"}
+		} else if r.ReadOnly {
+			newExtent.AccessMode = "RDONLY"
+		}
+
+		vmdk.Extents = append(vmdk.Extents, newExtent)
+	}
+
+	return vmdk.write(location, opts.Output)
+}
@@ -0,0 +1,180 @@
+package vmdk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// deviceInfo is what is known about the device a descriptor is checked
+// against. Sizes are expressed in descriptor sectors.
+type deviceInfo struct {
+	Name             string
+	Sectors          uint64
+	SectorSize       uint64
+	Table            *partitionTable
+	PartitionDevices map[uint64]string
+}
+
+func readDeviceInfo(deviceName string) (*deviceInfo, error) {
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	sectorSize, _, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDONLY)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	table, err := readDevicePartitions(dev, sectorSize)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &deviceInfo{
+		Name:       deviceName,
+		Sectors:    deviceSize / descriptorSectorSize,
+		SectorSize: sectorSize,
+		Table:      table,
+	}
+
+	// Partition device nodes are only available on some platforms
+	info.PartitionDevices, _ = backend.GetPartitionDevices(deviceName)
+
+	return info, nil
+}
+
+// partitionsAt returns the indexes of the partitions overlapping the range
+// of descriptor sectors from start to end, excluded
+func (info *deviceInfo) partitionsAt(start, end uint64) []string {
+	var indexes []string
+	for _, part := range info.Table.Partitions {
+		first := descriptorSectors(part.StartLBA(), info.SectorSize)
+		last := descriptorSectors(part.LastLBA+1, info.SectorSize)
+		if first < end && start < last {
+			indexes = append(indexes, fmt.Sprintf("%d", part.Index))
+		}
+	}
+	return indexes
+}
+
+// validate returns the inconsistencies between the descriptor and the device
+func (vmdk *rawVMDK) validate(info *deviceInfo) []string {
+	var problems []string
+	dir := filepath.Dir(vmdk.TargetPath)
+
+	if vmdk.LogicalSectorSize != info.SectorSize {
+		problems = append(problems, fmt.Sprintf("Descriptor sector size is %d, device sector size is %d", vmdk.LogicalSectorSize, info.SectorSize))
+	}
+
+	var start uint64
+	for i, e := range vmdk.Extents {
+		if e.Type == "FLAT" {
+			switch {
+			case e.Path == info.Name:
+				if e.Offset != start {
+					problems = append(problems, fmt.Sprintf("Extent %d maps sector %d to sector %d of the device", i, start, e.Offset))
+				}
+				if e.Offset+e.Size > info.Sectors {
+					problems = append(problems, fmt.Sprintf("Extent %d goes beyond the end of the device", i))
+				}
+			case filepath.IsAbs(e.Path) || strings.HasPrefix(e.Path, `\\`):
+				found := false
+				for partStart, partDevice := range info.PartitionDevices {
+					if partDevice == e.Path {
+						found = true
+						if partStart != start || e.Offset != 0 {
+							problems = append(problems, fmt.Sprintf("Extent %d maps sector %d to %s which starts at sector %d", i, start, e.Path, partStart))
+						}
+					}
+				}
+				if !found {
+					problems = append(problems, fmt.Sprintf("Extent %d refers to %s which is not a partition of %s", i, e.Path, info.Name))
+				}
+			default:
+				fi, err := os.Stat(filepath.Join(dir, e.Path))
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("Extent %d: %s", i, err.Error()))
+				} else if uint64(fi.Size()) < (e.Offset+e.Size)*descriptorSectorSize {
+					problems = append(problems, fmt.Sprintf("Extent %d: %s is too small", i, e.Path))
+				}
+			}
+		} else if e.Type == "SPARSE" {
+			if _, err := os.Stat(filepath.Join(dir, e.Path)); err != nil {
+				problems = append(problems, fmt.Sprintf("Extent %d: %s", i, err.Error()))
+			}
+		}
+		start += e.Size
+	}
+
+	if start != info.Sectors {
+		problems = append(problems, fmt.Sprintf("Extents cover %d sectors, device has %d sectors", start, info.Sectors))
+	}
+
+	return problems
+}
+
+// Inspect prints the extent map of the descriptor at location against the
+// partition table of the device and reports their inconsistencies
+func Inspect(w io.Writer, location string, deviceName string) error {
+	vmdk, err := readDescriptor(location)
+	if err != nil {
+		return err
+	}
+
+	info, err := readDeviceInfo(deviceName)
+	if err != nil {
+		return fmt.Errorf("Failed to read device %s: %s", deviceName, err.Error())
+	}
+
+	fmt.Fprintf(w, "Descriptor: %s (%s, UUID %s)\n", location, vmdk.Type, vmdk.UUID)
+	fmt.Fprintf(w, "Device: %s (%d sectors of %d bytes)\n\n", deviceName, info.Sectors*descriptorSectorSize/info.SectorSize, info.SectorSize)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tEND\tSIZE\tACCESS\tTYPE\tTARGET\tPARTITIONS")
+
+	var start uint64
+	for _, e := range vmdk.Extents {
+		target := "-"
+		switch e.Type {
+		case "FLAT":
+			target = fmt.Sprintf("%s@%d", e.Path, e.Offset)
+		case "SPARSE":
+			target = e.Path
+		}
+
+		partitions := strings.Join(info.partitionsAt(start, start+e.Size), ",")
+		if partitions == "" {
+			partitions = "-"
+		}
+
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\t%s\n", start, start+e.Size-1, e.Size, e.AccessMode, e.Type, target, partitions)
+		start += e.Size
+	}
+	tw.Flush()
+
+	problems := vmdk.validate(info)
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "\nNo problem found")
+		return nil
+	}
+
+	fmt.Fprintln(w, "\nProblems:")
+	for _, problem := range problems {
+		fmt.Fprintf(w, "  - %s\n", problem)
+	}
+
+	return fmt.Errorf("%d problem(s) found in %s", len(problems), location)
+}
@@ -0,0 +1,124 @@
+package vmdk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	regionZero = iota
+	regionHeader
+	regionEBR
+	regionPartition
+	regionBackupGPT
+)
+
+// region is a range of sectors of the device, and what it is mapped to
+type region struct {
+	Kind     int
+	FirstLBA uint64
+	Sectors  uint64
+	ReadOnly bool
+	// Partition is the partition the region belongs to, for partitions
+	// and extended boot records
+	Partition partition
+}
+
+// planLayout returns the regions covering the whole device described by
+// the partition table, in order. The partitions are mapped according to
+// the policy. All sizes are expressed in logical sectors of the table.
+func planLayout(table *partitionTable, deviceSize uint64, policy PartitionPolicy) ([]region, error) {
+	if table.SectorSize == 0 || deviceSize%table.SectorSize != 0 {
+		return nil, fmt.Errorf("Invalid sector size %d for a device of %d bytes", table.SectorSize, deviceSize)
+	}
+
+	if len(table.Partitions) == 0 {
+		return nil, errors.New("No partition found")
+	}
+
+	deviceSectors := deviceSize / table.SectorSize
+
+	partitions := make([]partition, len(table.Partitions))
+	copy(partitions, table.Partitions)
+	sort.Slice(partitions, func(i, j int) bool {
+		return partitions[i].StartLBA() < partitions[j].StartLBA()
+	})
+
+	var regions []region
+	offset := uint64(0)
+	for i, part := range partitions {
+		switch {
+		case part.FirstLBA > part.LastLBA:
+			return nil, fmt.Errorf("Partition %d ends (%d) before it starts (%d)", part.Index, part.LastLBA, part.FirstLBA)
+		case part.StartLBA() == 0:
+			return nil, fmt.Errorf("Partition %d overlaps the partition table", part.Index)
+		case part.LastLBA >= deviceSectors:
+			return nil, fmt.Errorf("Partition %d ends at sector %d, beyond the end of the device (%d sectors)", part.Index, part.LastLBA, deviceSectors)
+		case i > 0 && part.StartLBA() < offset:
+			previous := partitions[i-1]
+			return nil, fmt.Errorf("Partition %d (%d-%d) overlaps partition %d (%d-%d)",
+				part.Index, part.StartLBA(), part.LastLBA, previous.Index, previous.StartLBA(), previous.LastLBA)
+		}
+
+		if i == 0 {
+			regions = append(regions, region{Kind: regionHeader, Sectors: part.StartLBA()})
+		} else if part.StartLBA() > offset {
+			regions = append(regions, region{Kind: regionZero, FirstLBA: offset, Sectors: part.StartLBA() - offset})
+		}
+
+		if part.EBRLBA != 0 {
+			regions = append(regions, region{
+				Kind:      regionEBR,
+				FirstLBA:  part.EBRLBA,
+				Sectors:   part.FirstLBA - part.EBRLBA,
+				Partition: part,
+			})
+		}
+
+		partRegion := region{
+			Kind:      regionPartition,
+			FirstLBA:  part.FirstLBA,
+			Sectors:   part.LastLBA - part.FirstLBA + 1,
+			Partition: part,
+		}
+
+		switch policy.exposure(part) {
+		case exposeHidden:
+			partRegion.Kind = regionZero
+		case exposeReadOnly:
+			partRegion.ReadOnly = true
+		}
+
+		regions = append(regions, partRegion)
+		offset = part.LastLBA + 1
+	}
+
+	if table.BackupLastLBA != 0 {
+		switch {
+		case table.BackupFirstLBA > table.BackupLastLBA:
+			return nil, fmt.Errorf("Invalid backup GPT location %d-%d", table.BackupFirstLBA, table.BackupLastLBA)
+		case table.BackupLastLBA >= deviceSectors:
+			return nil, fmt.Errorf("Backup GPT at sector %d is beyond the end of the device (%d sectors)", table.BackupLastLBA, deviceSectors)
+		case table.BackupFirstLBA < offset:
+			return nil, fmt.Errorf("Backup GPT at sector %d overlaps the partitions", table.BackupFirstLBA)
+		}
+
+		if table.BackupFirstLBA > offset {
+			regions = append(regions, region{Kind: regionZero, FirstLBA: offset, Sectors: table.BackupFirstLBA - offset})
+		}
+
+		regions = append(regions, region{
+			Kind:     regionBackupGPT,
+			FirstLBA: table.BackupFirstLBA,
+			Sectors:  table.BackupLastLBA - table.BackupFirstLBA + 1,
+		})
+		offset = table.BackupLastLBA + 1
+	}
+
+	if offset < deviceSectors {
+		regions = append(regions, region{Kind: regionZero, FirstLBA: offset, Sectors: deviceSectors - offset})
+	}
+
+	return regions, nil
+}
@@ -0,0 +1,160 @@
+package vmdk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanLayout(t *testing.T) {
+	// A 1 MB device of 512 bytes sectors has 2048 sectors
+	const deviceSize = 2048 * 512
+
+	first := partition{Index: 1, FirstLBA: 34, LastLBA: 999}
+	second := partition{Index: 2, FirstLBA: 1000, LastLBA: 1999}
+	logical := partition{Index: 5, EBRLBA: 1000, FirstLBA: 1001, LastLBA: 1999}
+
+	tests := []struct {
+		name    string
+		table   partitionTable
+		policy  PartitionPolicy
+		regions []region
+		fails   bool
+	}{
+		{
+			name:  "empty table",
+			table: partitionTable{SectorSize: 512},
+			fails: true,
+		},
+		{
+			name:  "invalid sector size",
+			table: partitionTable{SectorSize: 4096, Partitions: []partition{first}},
+			fails: true,
+		},
+		{
+			name:  "single partition",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{first}},
+			regions: []region{
+				{Kind: regionHeader, Sectors: 34},
+				{Kind: regionPartition, FirstLBA: 34, Sectors: 966, Partition: first},
+				{Kind: regionZero, FirstLBA: 1000, Sectors: 1048},
+			},
+		},
+		{
+			name:  "unsorted partitions",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{second, first}},
+			regions: []region{
+				{Kind: regionHeader, Sectors: 34},
+				{Kind: regionPartition, FirstLBA: 34, Sectors: 966, Partition: first},
+				{Kind: regionPartition, FirstLBA: 1000, Sectors: 1000, Partition: second},
+				{Kind: regionZero, FirstLBA: 2000, Sectors: 48},
+			},
+		},
+		{
+			name: "gap between partitions",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{
+				{Index: 1, FirstLBA: 34, LastLBA: 499},
+				second,
+			}},
+			regions: []region{
+				{Kind: regionHeader, Sectors: 34},
+				{Kind: regionPartition, FirstLBA: 34, Sectors: 466, Partition: partition{Index: 1, FirstLBA: 34, LastLBA: 499}},
+				{Kind: regionZero, FirstLBA: 500, Sectors: 500},
+				{Kind: regionPartition, FirstLBA: 1000, Sectors: 1000, Partition: second},
+				{Kind: regionZero, FirstLBA: 2000, Sectors: 48},
+			},
+		},
+		{
+			name:  "logical partition",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{first, logical}},
+			regions: []region{
+				{Kind: regionHeader, Sectors: 34},
+				{Kind: regionPartition, FirstLBA: 34, Sectors: 966, Partition: first},
+				{Kind: regionEBR, FirstLBA: 1000, Sectors: 1, Partition: logical},
+				{Kind: regionPartition, FirstLBA: 1001, Sectors: 999, Partition: logical},
+				{Kind: regionZero, FirstLBA: 2000, Sectors: 48},
+			},
+		},
+		{
+			name:   "hidden and read-only partitions",
+			table:  partitionTable{SectorSize: 512, Partitions: []partition{first, second}},
+			policy: PartitionPolicy{Hide: []string{"1"}, ReadOnly: []string{"2"}},
+			regions: []region{
+				{Kind: regionHeader, Sectors: 34},
+				{Kind: regionZero, FirstLBA: 34, Sectors: 966, Partition: first},
+				{Kind: regionPartition, FirstLBA: 1000, Sectors: 1000, ReadOnly: true, Partition: second},
+				{Kind: regionZero, FirstLBA: 2000, Sectors: 48},
+			},
+		},
+		{
+			name: "overlapping partitions",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{
+				first,
+				{Index: 2, FirstLBA: 900, LastLBA: 1999},
+			}},
+			fails: true,
+		},
+		{
+			name:  "partition overlapping the partition table",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{{Index: 1, FirstLBA: 0, LastLBA: 999}}},
+			fails: true,
+		},
+		{
+			name:  "partition ending before it starts",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{{Index: 1, FirstLBA: 999, LastLBA: 34}}},
+			fails: true,
+		},
+		{
+			name:  "partition past the end of the device",
+			table: partitionTable{SectorSize: 512, Partitions: []partition{{Index: 1, FirstLBA: 34, LastLBA: 2048}}},
+			fails: true,
+		},
+		{
+			name: "backup GPT",
+			table: partitionTable{
+				SectorSize:     512,
+				Partitions:     []partition{first},
+				BackupFirstLBA: 2015,
+				BackupLastLBA:  2047,
+			},
+			regions: []region{
+				{Kind: regionHeader, Sectors: 34},
+				{Kind: regionPartition, FirstLBA: 34, Sectors: 966, Partition: first},
+				{Kind: regionZero, FirstLBA: 1000, Sectors: 1015},
+				{Kind: regionBackupGPT, FirstLBA: 2015, Sectors: 33},
+			},
+		},
+		{
+			// A backup GPT outside the device is rejected
+			name: "backup GPT past the end of the device",
+			table: partitionTable{
+				SectorSize:     512,
+				Partitions:     []partition{first},
+				BackupFirstLBA: 4063,
+				BackupLastLBA:  4095,
+			},
+			fails: true,
+		},
+		{
+			name: "backup GPT overlapping a partition",
+			table: partitionTable{
+				SectorSize:     512,
+				Partitions:     []partition{first},
+				BackupFirstLBA: 990,
+				BackupLastLBA:  1022,
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		regions, err := planLayout(&test.table, deviceSize, test.policy)
+		switch {
+		case test.fails && err == nil:
+			t.Errorf("%s: expected an error, got %+v", test.name, regions)
+		case !test.fails && err != nil:
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+		case !test.fails && !reflect.DeepEqual(regions, test.regions):
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.regions, regions)
+		}
+	}
+}
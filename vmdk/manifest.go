@@ -0,0 +1,360 @@
+package vmdk
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+const (
+	// manifestSamples is the number of chunks hashed in sampled mode
+	manifestSamples = 64
+	// manifestSampleSize is the size of the sampled chunks
+	manifestSampleSize = 64 * 1024
+)
+
+// ManifestPartition holds the hashes of a partition
+type ManifestPartition struct {
+	Index    int    `json:"index"`
+	FirstLBA uint64 `json:"first_lba"`
+	LastLBA  uint64 `json:"last_lba"`
+	// Hash covers the whole partition, SampledHash only evenly spread chunks
+	Hash        string `json:"hash"`
+	SampledHash string `json:"sampled_hash"`
+}
+
+// Manifest describes the expected content of a device
+type Manifest struct {
+	SectorSize uint64 `json:"sector_size"`
+	// TableHash covers the partition table structures and the boot code
+	// before the first partition
+	TableHash  string              `json:"table_hash"`
+	Partitions []ManifestPartition `json:"partitions"`
+	Signature  string              `json:"signature,omitempty"`
+}
+
+// hashTable hashes all the regions of the device that are not partitions
+func hashTable(dev backend.DeviceFile, table *partitionTable, deviceSize uint64) (string, error) {
+	regions, err := planLayout(table, deviceSize, PartitionPolicy{})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, r := range regions {
+		switch r.Kind {
+		case regionHeader, regionEBR, regionBackupGPT:
+			if err := copySectors(dev, hash, table.SectorSize, r.FirstLBA, r.Sectors); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashPartition hashes the whole partition, or only manifestSamples chunks
+// of it if sampled is set
+func hashPartition(dev backend.DeviceFile, sectorSize uint64, part partition, sampled bool) (string, error) {
+	hash := sha256.New()
+	count := part.LastLBA - part.FirstLBA + 1
+	chunk := manifestSampleSize / sectorSize
+
+	if !sampled || count <= manifestSamples*chunk {
+		if err := copySectors(dev, hash, sectorSize, part.FirstLBA, count); err != nil {
+			return "", err
+		}
+	} else {
+		for i := uint64(0); i < manifestSamples; i++ {
+			offset := i * (count - chunk) / (manifestSamples - 1)
+			if err := copySectors(dev, hash, sectorSize, part.FirstLBA+offset, chunk); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func openManifestDevice(deviceName string) (backend.DeviceFile, *partitionTable, uint64, error) {
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	sectorSize, _, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDONLY)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+
+	table, err := readDevicePartitions(dev, sectorSize)
+	if err != nil {
+		dev.Close()
+		return nil, nil, 0, err
+	}
+
+	return dev, table, deviceSize, nil
+}
+
+// CreateManifest hashes the partition table of the device and the
+// partitions matching keys, as partition indexes, GUIDs or labels
+func CreateManifest(deviceName string, keys []string) (*Manifest, error) {
+	dev, table, deviceSize, err := openManifestDevice(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+
+	manifest := &Manifest{SectorSize: table.SectorSize}
+	if manifest.TableHash, err = hashTable(dev, table, deviceSize); err != nil {
+		return nil, fmt.Errorf("Failed to hash partition table: %s", err.Error())
+	}
+
+	for _, part := range table.Partitions {
+		if !part.matches(keys) {
+			continue
+		}
+
+		entry := ManifestPartition{Index: part.Index, FirstLBA: part.FirstLBA, LastLBA: part.LastLBA}
+		if entry.Hash, err = hashPartition(dev, table.SectorSize, part, false); err != nil {
+			return nil, fmt.Errorf("Failed to hash partition %d: %s", part.Index, err.Error())
+		}
+		if entry.SampledHash, err = hashPartition(dev, table.SectorSize, part, true); err != nil {
+			return nil, fmt.Errorf("Failed to hash partition %d: %s", part.Index, err.Error())
+		}
+		manifest.Partitions = append(manifest.Partitions, entry)
+	}
+
+	return manifest, nil
+}
+
+// Verify checks the device against the manifest. Only chunks of the
+// partitions are hashed if sampled is set.
+func (m *Manifest) Verify(deviceName string, sampled bool) error {
+	dev, table, deviceSize, err := openManifestDevice(deviceName)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	if table.SectorSize != m.SectorSize {
+		return fmt.Errorf("Sector size is %d, expected %d", table.SectorSize, m.SectorSize)
+	}
+
+	var problems []string
+	tableHash, err := hashTable(dev, table, deviceSize)
+	if err != nil {
+		return fmt.Errorf("Failed to hash partition table: %s", err.Error())
+	}
+
+	if tableHash != m.TableHash {
+		problems = append(problems, "partition table was modified")
+	}
+
+	for _, entry := range m.Partitions {
+		var current *partition
+		for i := range table.Partitions {
+			if table.Partitions[i].Index == entry.Index {
+				current = &table.Partitions[i]
+			}
+		}
+
+		switch {
+		case current == nil:
+			problems = append(problems, fmt.Sprintf("partition %d is missing", entry.Index))
+			continue
+		case current.FirstLBA != entry.FirstLBA || current.LastLBA != entry.LastLBA:
+			problems = append(problems, fmt.Sprintf("partition %d was moved or resized", entry.Index))
+			continue
+		}
+
+		hash, err := hashPartition(dev, table.SectorSize, *current, sampled)
+		if err != nil {
+			return fmt.Errorf("Failed to hash partition %d: %s", entry.Index, err.Error())
+		}
+
+		expected := entry.Hash
+		if sampled {
+			expected = entry.SampledHash
+		}
+
+		if hash != expected {
+			problems = append(problems, fmt.Sprintf("partition %d was modified", entry.Index))
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// digest returns the hash of the manifest without its signature
+func (m *Manifest) digest() ([]byte, error) {
+	unsigned := *m
+	unsigned.Signature = ""
+
+	data, err := json.Marshal(&unsigned)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// Sign signs the manifest with the private key
+func (m *Manifest) Sign(key *ecdsa.PrivateKey) error {
+	digest, err := m.digest()
+	if err != nil {
+		return err
+	}
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+	if err != nil {
+		return err
+	}
+
+	// The signature is the concatenation of r and s, padded to the size
+	// of the curve
+	size := (key.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[size-len(rBytes):size], rBytes)
+	copy(signature[2*size-len(sBytes):], sBytes)
+
+	m.Signature = base64.StdEncoding.EncodeToString(signature)
+	return nil
+}
+
+// VerifySignature checks the signature of the manifest with the public key
+func (m *Manifest) VerifySignature(key *ecdsa.PublicKey) error {
+	if m.Signature == "" {
+		return errors.New("Manifest is not signed")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature: %s", err.Error())
+	}
+
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(signature) != 2*size {
+		return errors.New("Invalid signature length")
+	}
+
+	digest, err := m.digest()
+	if err != nil {
+		return err
+	}
+
+	r := new(big.Int).SetBytes(signature[:size])
+	s := new(big.Int).SetBytes(signature[size:])
+	if !ecdsa.Verify(key, digest, r, s) {
+		return errors.New("Invalid manifest signature")
+	}
+
+	return nil
+}
+
+// Write writes the manifest to location
+func (m *Manifest) Write(location string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(location, append(data, '\n'), 0644)
+}
+
+// ReadManifest reads the manifest at location
+func ReadManifest(location string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Failed to parse manifest %s: %s", location, err.Error())
+	}
+
+	return manifest, nil
+}
+
+func readPEM(location string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", location)
+	}
+
+	return block, nil
+}
+
+// LoadPrivateKey loads the PEM encoded EC private key at location
+func LoadPrivateKey(location string) (*ecdsa.PrivateKey, error) {
+	block, err := readPEM(location)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse private key %s: %s", location, err.Error())
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an EC private key", location)
+	}
+
+	return ecKey, nil
+}
+
+// LoadPublicKey loads the PEM encoded EC public key at location
+func LoadPublicKey(location string) (*ecdsa.PublicKey, error) {
+	block, err := readPEM(location)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse public key %s: %s", location, err.Error())
+	}
+
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an EC public key", location)
+	}
+
+	return ecKey, nil
+}
@@ -0,0 +1,232 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// Partition type GUIDs hinting at the guest operating system
+const (
+	linuxRootX86GUID    = "44479540-F297-41B2-9AF7-D131D5F0458A"
+	linuxRootX86_64GUID = "4F68BCE3-E8CD-4DB1-96E7-FBCAF984B709"
+	linuxLVMGUID        = "E6D6D379-F507-44C2-A23C-238F2A3DF928"
+	msReservedGUID      = "E3C9E316-0B5C-4DB8-817D-F92DF00215AE"
+	hfsPlusGUID         = "48465300-0000-11AA-AA11-00306543ECAC"
+	apfsGUID            = "7C3457EF-0000-11AA-AA11-00306543ECAC"
+)
+
+// osEvidence collects what was found on the disk
+type osEvidence struct {
+	Linux     bool
+	Windows   bool
+	WindowsXP bool
+	Mac       bool
+	X86       bool
+	X86_64    bool
+}
+
+// addBootCode looks for the strings of well known bootloaders in boot code
+func (ev *osEvidence) addBootCode(code []byte) {
+	switch {
+	case bytes.Contains(code, []byte("GRUB")):
+		ev.Linux = true
+	case bytes.Contains(code, []byte("BOOTMGR")):
+		ev.Windows = true
+	case bytes.Contains(code, []byte("NTLDR")):
+		ev.WindowsXP = true
+	}
+}
+
+// PE machine types of EFI applications
+const (
+	peMachineI386  = 0x014c
+	peMachineAMD64 = 0x8664
+)
+
+// peMachine returns the machine type of the PE image starting with data,
+// or 0 if it is not one
+func peMachine(data []byte) uint16 {
+	if len(data) < 0x40 || string(data[:2]) != "MZ" {
+		return 0
+	}
+
+	offset := uint64(binary.LittleEndian.Uint32(data[0x3c:]))
+	if offset+6 > uint64(len(data)) || string(data[offset:offset+4]) != "PE\x00\x00" {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(data[offset+4:])
+}
+
+// addEFIApplications looks at the architecture of the EFI applications,
+// such as BOOTX64.EFI, shim, GRUB or the Windows boot manager, stored in
+// /EFI on the FAT volume
+func (ev *osEvidence) addEFIApplications(vol *fatVolume) error {
+	efi, err := vol.lookup("EFI")
+	if err != nil || efi == nil || !efi.Dir {
+		return err
+	}
+	return ev.addEFIDirectory(vol, efi, 3)
+}
+
+func (ev *osEvidence) addEFIDirectory(vol *fatVolume, dir *fatEntry, depth int) error {
+	entries, err := vol.list(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Dir {
+			if depth > 1 {
+				if err := ev.addEFIDirectory(vol, &entry, depth-1); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(strings.ToLower(entry.Name), ".efi") {
+			continue
+		}
+
+		data, err := vol.read(&entry, 4096)
+		if err != nil {
+			return err
+		}
+
+		switch peMachine(data) {
+		case peMachineI386:
+			ev.X86 = true
+		case peMachineAMD64:
+			ev.X86_64 = true
+		}
+	}
+
+	return nil
+}
+
+func (ev *osEvidence) addPartition(part partition, filesystem string) {
+	switch {
+	case strings.EqualFold(part.TypeGUID, linuxRootX86GUID):
+		ev.Linux, ev.X86 = true, true
+	case strings.EqualFold(part.TypeGUID, linuxRootX86_64GUID):
+		ev.Linux, ev.X86_64 = true, true
+	case strings.EqualFold(part.TypeGUID, linuxFilesystemGUID), strings.EqualFold(part.TypeGUID, linuxLVMGUID):
+		ev.Linux = true
+	case strings.EqualFold(part.TypeGUID, msReservedGUID):
+		ev.Windows = true
+	case strings.EqualFold(part.TypeGUID, hfsPlusGUID), strings.EqualFold(part.TypeGUID, apfsGUID):
+		ev.Mac = true
+	case part.Type == 0x83 || part.Type == 0x8e:
+		ev.Linux = true
+	case part.Type == 0xaf:
+		ev.Mac = true
+	}
+
+	switch filesystem {
+	case "ext", "btrfs":
+		ev.Linux = true
+	case "hfsplus", "apfs":
+		ev.Mac = true
+	case "ntfs":
+		ev.Windows = true
+	}
+}
+
+// osType returns the VirtualBox OS type matching the evidence. Linux wins
+// over Windows as Linux keys often carry NTFS data partitions.
+func (ev *osEvidence) osType() (string, error) {
+	var osType string
+	switch {
+	case ev.Mac:
+		osType = "MacOS"
+	case ev.Linux:
+		osType = "Linux"
+	case ev.WindowsXP:
+		return "WindowsXP", nil
+	case ev.Windows:
+		osType = "Windows10"
+	default:
+		return "", errors.New("No known operating system found")
+	}
+
+	is64 := ev.X86_64
+	if !ev.X86 && !ev.X86_64 {
+		is64 = runtime.GOARCH == "amd64" || runtime.GOARCH == "arm64"
+		log.Printf("No hint of the guest architecture found, assuming it matches the host (%s)\n", runtime.GOARCH)
+	}
+
+	if is64 {
+		osType += "_64"
+	}
+	return osType, nil
+}
+
+// DetectOSType guesses the VirtualBox OS type of the system installed on
+// the device, disk image or VDI at location, from its partition types,
+// filesystems and bootloaders. The architecture comes from the partition
+// types and the EFI applications.
+func DetectOSType(location string) (string, error) {
+	r, table, closer, err := openDisk(location)
+	if err != nil {
+		return "", err
+	}
+	defer closer.Close()
+
+	var ev osEvidence
+
+	mbr := make([]byte, table.SectorSize)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, mbr); err != nil {
+		return "", err
+	}
+	ev.addBootCode(mbr[:440])
+
+	data := make([]byte, alignUp(backend.ProbeSize, table.SectorSize))
+	for _, part := range table.Partitions {
+		size := (part.LastLBA - part.FirstLBA + 1) * table.SectorSize
+		probe := data
+		if size < uint64(len(probe)) {
+			probe = probe[:size]
+		}
+
+		if _, err := r.Seek(int64(part.FirstLBA*table.SectorSize), io.SeekStart); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(r, probe); err != nil {
+			log.Printf("Failed to read partition %d: %s\n", part.Index, err.Error())
+			continue
+		}
+
+		filesystem := backend.DetectFilesystem(probe)
+		ev.addPartition(part, filesystem)
+		if filesystem == "ntfs" || filesystem == "fat" {
+			// The volume boot record names the loader it chains to
+			vbr := probe
+			if len(vbr) > 8192 {
+				vbr = vbr[:8192]
+			}
+			ev.addBootCode(vbr)
+		}
+
+		if filesystem == "fat" {
+			vol, err := openFAT(r, part.FirstLBA*table.SectorSize)
+			if err == nil {
+				err = ev.addEFIApplications(vol)
+			}
+			if err != nil {
+				log.Printf("Failed to look for EFI applications in partition %d: %s\n", part.Index, err.Error())
+			}
+		}
+	}
+
+	return ev.osType()
+}
@@ -0,0 +1,315 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// fatBuilder lays out a FAT filesystem of 512 bytes clusters in memory
+type fatBuilder struct {
+	bits        int
+	image       []byte
+	fatOffset   int
+	dataOffset  int
+	nextCluster uint32
+}
+
+// buildFAT returns a FAT filesystem of the given number of sectors holding
+// the files, indexed by their path
+func buildFAT(bits int, sectors int, files map[string][]byte) []byte {
+	reserved, rootEntries := 1, 512
+	if bits == 32 {
+		reserved, rootEntries = 32, 0
+	}
+	fatSectors := (sectors*bits/8 + 8 + 511) / 512
+	rootSectors := rootEntries * 32 / 512
+
+	b := &fatBuilder{
+		bits:        bits,
+		image:       make([]byte, sectors*512),
+		fatOffset:   reserved * 512,
+		dataOffset:  (reserved + fatSectors + rootSectors) * 512,
+		nextCluster: 2,
+	}
+
+	boot := b.image
+	copy(boot[0:], []byte{0xeb, 0x3c, 0x90})
+	binary.LittleEndian.PutUint16(boot[11:], 512)
+	boot[13] = 1
+	binary.LittleEndian.PutUint16(boot[14:], uint16(reserved))
+	boot[16] = 1
+	binary.LittleEndian.PutUint16(boot[17:], uint16(rootEntries))
+	binary.LittleEndian.PutUint32(boot[32:], uint32(sectors))
+	if bits == 32 {
+		binary.LittleEndian.PutUint32(boot[36:], uint32(fatSectors))
+	} else {
+		binary.LittleEndian.PutUint16(boot[22:], uint16(fatSectors))
+	}
+	boot[510], boot[511] = 0x55, 0xaa
+
+	// Directories are made of the paths of the files
+	tree := map[string][]string{}
+	for path := range files {
+		components := strings.Split(path, "/")
+		for i := range components {
+			parent, child := strings.Join(components[:i], "/"), strings.Join(components[:i+1], "/")
+			if !contains(tree[parent], child) {
+				tree[parent] = append(tree[parent], child)
+			}
+		}
+	}
+
+	root := b.directory("", tree, files)
+	if bits == 32 {
+		cluster := b.allocate(root)
+		binary.LittleEndian.PutUint32(boot[44:], cluster)
+	} else {
+		copy(b.image[b.fatOffset+fatSectors*512:], root)
+	}
+
+	return b.image
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// directory returns the content of the directory at path, allocating the
+// clusters of its files and subdirectories
+func (b *fatBuilder) directory(path string, tree map[string][]string, files map[string][]byte) []byte {
+	children := tree[path]
+	sort.Strings(children)
+
+	var content bytes.Buffer
+	for i, child := range children {
+		var cluster uint32
+		var size uint32
+		var attributes byte
+		if data, found := files[child]; found {
+			cluster, size = b.allocate(data), uint32(len(data))
+		} else {
+			cluster, attributes = b.allocate(b.directory(child, tree, files)), 0x10
+		}
+
+		// Every entry gets a long name, stored last part first
+		name := utf16.Encode([]rune(child[strings.LastIndex(child, "/")+1:]))
+		name = append(name, 0)
+		for len(name)%13 != 0 {
+			name = append(name, 0xffff)
+		}
+		for part := len(name)/13 - 1; part >= 0; part-- {
+			entry := make([]byte, 32)
+			entry[0] = byte(part + 1)
+			if part == len(name)/13-1 {
+				entry[0] |= 0x40
+			}
+			entry[11] = 0x0f
+			for j, offset := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+				binary.LittleEndian.PutUint16(entry[offset:], name[part*13+j])
+			}
+			content.Write(entry)
+		}
+
+		entry := make([]byte, 32)
+		copy(entry, []byte(strings.ToUpper(strings.Repeat(string(rune('A'+i)), 6))+"~1   "))
+		entry[11] = attributes
+		binary.LittleEndian.PutUint16(entry[20:], uint16(cluster>>16))
+		binary.LittleEndian.PutUint16(entry[26:], uint16(cluster))
+		binary.LittleEndian.PutUint32(entry[28:], size)
+		content.Write(entry)
+	}
+
+	return content.Bytes()
+}
+
+// allocate stores data in a chain of clusters and returns its first cluster
+func (b *fatBuilder) allocate(data []byte) uint32 {
+	count := (len(data) + 511) / 512
+	if count == 0 {
+		count = 1
+	}
+
+	first := b.nextCluster
+	for i := 0; i < count; i++ {
+		cluster := b.nextCluster
+		b.nextCluster++
+
+		next := cluster + 1
+		if i == count-1 {
+			next = 0x0fffffff
+		}
+		b.setFAT(cluster, next)
+
+		start := i * 512
+		end := start + 512
+		if end > len(data) {
+			end = len(data)
+		}
+		copy(b.image[b.dataOffset+int(cluster-2)*512:], data[start:end])
+	}
+	return first
+}
+
+func (b *fatBuilder) setFAT(cluster uint32, value uint32) {
+	fat := b.image[b.fatOffset:]
+	switch b.bits {
+	case 12:
+		offset := cluster * 3 / 2
+		current := binary.LittleEndian.Uint16(fat[offset:])
+		if cluster&1 == 1 {
+			current = current&0x000f | uint16(value&0xfff)<<4
+		} else {
+			current = current&0xf000 | uint16(value&0xfff)
+		}
+		binary.LittleEndian.PutUint16(fat[offset:], current)
+	case 16:
+		binary.LittleEndian.PutUint16(fat[cluster*2:], uint16(value))
+	default:
+		binary.LittleEndian.PutUint32(fat[cluster*4:], value&0x0fffffff)
+	}
+}
+
+// peImage returns the start of a PE image for the machine type
+func peImage(machine uint16) []byte {
+	data := make([]byte, 1024)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x80)
+	copy(data[0x80:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(data[0x84:], machine)
+	return data
+}
+
+func TestFATLookup(t *testing.T) {
+	content := bytes.Repeat([]byte("vlaunch "), 200)
+	files := map[string][]byte{
+		"EFI/BOOT/BOOTX64.EFI":          peImage(peMachineAMD64),
+		"EFI/Microsoft/Boot/BCD":        content,
+		"a file with a long name.txt":   []byte("long"),
+		"EFI/Microsoft/Boot/empty file": {},
+	}
+
+	for _, test := range []struct {
+		bits    int
+		sectors int
+	}{
+		{bits: 12, sectors: 2048},
+		{bits: 16, sectors: 16384},
+		{bits: 32, sectors: 70000},
+	} {
+		vol, err := openFAT(bytes.NewReader(buildFAT(test.bits, test.sectors, files)), 0)
+		if err != nil {
+			t.Errorf("FAT%d: %s", test.bits, err.Error())
+			continue
+		}
+		if vol.bits != test.bits {
+			t.Errorf("FAT%d: detected as FAT%d", test.bits, vol.bits)
+		}
+
+		for path, data := range files {
+			entry, err := vol.lookup(strings.Split(strings.ToLower(path), "/")...)
+			if err != nil || entry == nil {
+				t.Errorf("FAT%d: failed to look up %s: %v", test.bits, path, err)
+				continue
+			}
+
+			read, err := vol.read(entry, 1<<20)
+			if err != nil || !bytes.Equal(read, data) {
+				t.Errorf("FAT%d: wrong content for %s: %v", test.bits, path, err)
+			}
+		}
+
+		if entry, err := vol.lookup("EFI", "BOOT", "BOOTIA32.EFI"); entry != nil || err != nil {
+			t.Errorf("FAT%d: expected BOOTIA32.EFI to be missing, got %+v, %v", test.bits, entry, err)
+		}
+		if entry, err := vol.lookup("a file with a long name.txt", "BOOT"); entry != nil || err != nil {
+			t.Errorf("FAT%d: expected a file not to be listed as a directory, got %+v, %v", test.bits, entry, err)
+		}
+	}
+}
+
+func TestGuestArchitecture(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string][]byte
+		x86    bool
+		x86_64 bool
+	}{
+		{
+			name:   "64 bits removable media path",
+			files:  map[string][]byte{"EFI/BOOT/BOOTX64.EFI": peImage(peMachineAMD64)},
+			x86_64: true,
+		},
+		{
+			name:  "32 bits removable media path",
+			files: map[string][]byte{"EFI/BOOT/BOOTIA32.EFI": peImage(peMachineI386)},
+			x86:   true,
+		},
+		{
+			name: "64 bits Windows boot manager",
+			files: map[string][]byte{
+				"EFI/Microsoft/Boot/bootmgfw.efi": peImage(peMachineAMD64),
+				"EFI/Microsoft/Boot/BCD":          []byte("regf"),
+			},
+			x86_64: true,
+		},
+		{
+			name:  "32 bits GRUB",
+			files: map[string][]byte{"EFI/debian/grubia32.efi": peImage(peMachineI386)},
+			x86:   true,
+		},
+		{
+			name:  "not an EFI system partition",
+			files: map[string][]byte{"README.TXT": []byte("data")},
+		},
+	}
+
+	for _, test := range tests {
+		vol, err := openFAT(bytes.NewReader(buildFAT(12, 2048, test.files)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ev osEvidence
+		if err := ev.addEFIApplications(vol); err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err.Error())
+			continue
+		}
+		if ev.X86 != test.x86 || ev.X86_64 != test.x86_64 {
+			t.Errorf("%s: expected x86 %t x86_64 %t, got %t %t", test.name, test.x86, test.x86_64, ev.X86, ev.X86_64)
+		}
+	}
+}
+
+func TestOSType(t *testing.T) {
+	tests := []struct {
+		evidence osEvidence
+		osType   string
+	}{
+		{evidence: osEvidence{Linux: true, X86_64: true}, osType: "Linux_64"},
+		{evidence: osEvidence{Linux: true, X86: true}, osType: "Linux"},
+		{evidence: osEvidence{Windows: true, X86_64: true}, osType: "Windows10_64"},
+		{evidence: osEvidence{Windows: true, X86: true}, osType: "Windows10"},
+		{evidence: osEvidence{Linux: true, Windows: true, X86: true, X86_64: true}, osType: "Linux_64"},
+		{evidence: osEvidence{WindowsXP: true, X86_64: true}, osType: "WindowsXP"},
+		{evidence: osEvidence{Mac: true, X86_64: true}, osType: "MacOS_64"},
+	}
+
+	for _, test := range tests {
+		if osType, err := test.evidence.osType(); err != nil || osType != test.osType {
+			t.Errorf("%+v: expected %s, got %s (%v)", test.evidence, test.osType, osType, err)
+		}
+	}
+
+	if _, err := (&osEvidence{X86_64: true}).osType(); err == nil {
+		t.Errorf("expected an error without operating system")
+	}
+}
@@ -0,0 +1,132 @@
+package vmdk
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/google/uuid"
+	"github.com/lebauce/vlaunch/backend"
+)
+
+type byteRange struct {
+	Start uint64
+	End   uint64
+}
+
+// OverlayParentUUID returns the UUID of the base image the overlay at
+// location was created from
+func OverlayParentUUID(location string) (uuid.UUID, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer file.Close()
+
+	image, err := readVDI(file)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return image.ParentUUID(), nil
+}
+
+// CommitOverlay writes the blocks the guest modified in the overlay back
+// to the device. Only the ranges exposed read-write by the raw VMDK, the
+// partition table structures and the partitions allowed by the policy,
+// are written. The partitions written must not be mounted.
+func CommitOverlay(location string, deviceName string, policy PartitionPolicy) error {
+	file, err := os.Open(location)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	image, err := readVDI(file)
+	if err != nil {
+		return err
+	}
+
+	if image.header.Type != vdiImageTypeDiff {
+		return fmt.Errorf("%s is not a differencing image", location)
+	}
+
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	if image.header.DiskSize != deviceSize {
+		return fmt.Errorf("Overlay size (%d) does not match device size (%d)", image.header.DiskSize, deviceSize)
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	sectorSize, _, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	table, err := readDevicePartitions(dev, sectorSize)
+	if err != nil {
+		return err
+	}
+
+	regions, err := planLayout(table, deviceSize, policy)
+	if err != nil {
+		return err
+	}
+
+	var ranges []byteRange
+	for _, r := range regions {
+		if r.Kind != regionZero && !r.ReadOnly {
+			ranges = append(ranges, byteRange{Start: r.FirstLBA * table.SectorSize, End: (r.FirstLBA + r.Sectors) * table.SectorSize})
+		}
+	}
+
+	var written uint64
+	data := make([]byte, image.header.BlockSize)
+	for i := range image.blockMap {
+		allocated, err := image.readBlock(uint32(i), data)
+		if err != nil {
+			return fmt.Errorf("Failed to read block %d of overlay: %s", i, err.Error())
+		}
+
+		if !allocated {
+			continue
+		}
+
+		blockStart := uint64(i) * uint64(image.header.BlockSize)
+		blockEnd := blockStart + uint64(image.header.BlockSize)
+		for _, r := range ranges {
+			start, end := r.Start, r.End
+			if start < blockStart {
+				start = blockStart
+			}
+			if end > blockEnd {
+				end = blockEnd
+			}
+			if start >= end {
+				continue
+			}
+
+			if _, err := dev.Seek(int64(start), io.SeekStart); err != nil {
+				return err
+			}
+
+			if _, err := dev.Write(data[start-blockStart : end-blockStart]); err != nil {
+				return fmt.Errorf("Failed to write at offset %d: %s", start, err.Error())
+			}
+
+			written += end - start
+		}
+	}
+
+	log.Printf("Committed %d bytes from %s to %s\n", written, location, deviceName)
+	return nil
+}
@@ -0,0 +1,246 @@
+package vmdk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/rekby/gpt"
+	"github.com/rekby/mbr"
+)
+
+type partition struct {
+	// Index is the number of the partition, as used by the operating
+	// systems to name it. Logical partitions start at 5.
+	Index    int
+	FirstLBA uint64
+	LastLBA  uint64
+	// EBRLBA is the sector of the extended boot record describing a
+	// logical partition. The sectors from EBRLBA up to FirstLBA are
+	// part of the EBR area. It is zero for other partitions.
+	EBRLBA uint64
+	// GUID, TypeGUID and Label are only set for GPT partitions
+	GUID     string
+	TypeGUID string
+	Label    string
+	// Type is the partition type byte of MBR partitions
+	Type byte
+	// Bootable is the active flag of MBR partitions, or the legacy BIOS
+	// bootable attribute of GPT partitions
+	Bootable bool
+}
+
+// StartLBA returns the first sector used by the partition, including its
+// extended boot record
+func (p partition) StartLBA() uint64 {
+	if p.EBRLBA != 0 {
+		return p.EBRLBA
+	}
+	return p.FirstLBA
+}
+
+type partitionTable struct {
+	// SectorSize is the size in bytes of the logical sectors the
+	// partition table is expressed in
+	SectorSize uint64
+	// DiskGUID is the GUID of GPT disks
+	DiskGUID   string
+	Partitions []partition
+	// BackupFirstLBA and BackupLastLBA delimit the backup GPT header and
+	// partition array at the end of the disk. They are zero on MBR disks.
+	BackupFirstLBA uint64
+	BackupLastLBA  uint64
+}
+
+func readPartitions(r io.ReadSeeker, sectorSize uint64) (*partitionTable, error) {
+	var parts []partition
+
+	// The GPT header is stored in the second logical sector
+	r.Seek(int64(sectorSize), io.SeekStart)
+	table, err := gpt.ReadTable(r, sectorSize)
+	if err == nil {
+		for i, part := range table.Partitions {
+			if !part.IsEmpty() {
+				parts = append(parts, partition{
+					Index:    i + 1,
+					FirstLBA: part.FirstLBA,
+					LastLBA:  part.LastLBA,
+					GUID:     part.Id.String(),
+					TypeGUID: part.Type.String(),
+					Label:    strings.TrimRight(part.Name(), "\x00"),
+					Bootable: part.Flags[0]&0x04 != 0,
+				})
+			}
+		}
+
+		// The backup partition array sits right before the backup header
+		arraySize := uint64(table.Header.PartitionsArrLen) * uint64(table.Header.PartitionEntrySize)
+		arraySectors := (arraySize + sectorSize - 1) / sectorSize
+		backupLBA := table.Header.HeaderCopyStartLBA
+
+		return &partitionTable{
+			SectorSize:     sectorSize,
+			DiskGUID:       table.Header.DiskGUID.String(),
+			Partitions:     parts,
+			BackupFirstLBA: backupLBA - arraySectors,
+			BackupLastLBA:  backupLBA,
+		}, nil
+	}
+
+	// The MBR is kept to read the active flags, which the mbr package
+	// does not expose
+	sector := make([]byte, 512)
+	r.Seek(0, io.SeekStart)
+	if _, err := io.ReadFull(r, sector); err != nil {
+		return nil, err
+	}
+
+	mbr, err := mbr.Read(bytes.NewReader(sector))
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range mbr.GetAllPartitions() {
+		if part.IsEmpty() {
+			continue
+		}
+
+		if backend.IsExtendedPartition(byte(part.GetType())) {
+			logicals, err := backend.ReadLogicalPartitions(r, sectorSize, uint64(part.GetLBAStart()), uint64(part.GetLBALast()))
+			if err != nil {
+				return nil, err
+			}
+			for _, logical := range logicals {
+				parts = append(parts, partition{
+					Index:    logical.Index,
+					FirstLBA: logical.FirstLBA,
+					LastLBA:  logical.LastLBA,
+					EBRLBA:   logical.EBRLBA,
+					Type:     logical.Type,
+					Bootable: logical.Bootable,
+				})
+			}
+			continue
+		}
+
+		parts = append(parts, partition{
+			Index:    part.Num,
+			FirstLBA: uint64(part.GetLBAStart()),
+			LastLBA:  uint64(part.GetLBALast()),
+			Type:     byte(part.GetType()),
+			Bootable: sector[446+16*(part.Num-1)] == 0x80,
+		})
+	}
+
+	return &partitionTable{SectorSize: sectorSize, Partitions: parts}, nil
+}
+
+// deviceReader serves the first blocks of the device from memory and the
+// rest directly from the device. Reads past the first blocks must be
+// sector aligned.
+type deviceReader struct {
+	head []byte
+	dev  io.ReadSeeker
+	pos  int64
+}
+
+func (r *deviceReader) Read(p []byte) (int, error) {
+	if r.pos < int64(len(r.head)) {
+		n := copy(p, r.head[r.pos:])
+		r.pos += int64(n)
+		return n, nil
+	}
+
+	if _, err := r.dev.Seek(r.pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := r.dev.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *deviceReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		r.pos = offset
+	case io.SeekCurrent:
+		r.pos += offset
+	default:
+		return r.pos, errors.New("Unsupported seek")
+	}
+	return r.pos, nil
+}
+
+// readDevicePartitions reads the partition table of the device, whose
+// logical sectors are sectorSize bytes long
+func readDevicePartitions(dev backend.DeviceFile, sectorSize uint64) (*partitionTable, error) {
+	// For some reason, passing directly the device to gpt.ReadTable
+	// doesn't work on Windows. So we read the beginning and pass it to
+	// gpt.ReadTable.
+	data := make([]byte, 32768)
+	if _, err := dev.Read(data); err != nil {
+		return nil, fmt.Errorf("Failed to read: %s", err.Error())
+	}
+
+	table, err := readPartitions(&deviceReader{head: data, dev: dev}, sectorSize)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read GPT or MBR table: %s", err.Error())
+	}
+
+	return table, nil
+}
+
+// openDisk opens the device, disk image or VDI at location and reads its
+// partition table. The returned reader serves the content of the disk,
+// and must only be read by whole sectors.
+func openDisk(location string) (io.ReadSeeker, *partitionTable, io.Closer, error) {
+	fi, err := os.Stat(location)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !fi.Mode().IsRegular() {
+		sectorSize, _, err := backend.GetSectorSize(location)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		dev, err := backend.OpenDevice(location, os.O_RDONLY)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("Failed to open device: %s", err.Error())
+		}
+
+		table, err := readDevicePartitions(dev, sectorSize)
+		if err != nil {
+			dev.Close()
+			return nil, nil, nil, err
+		}
+
+		return dev, table, dev, nil
+	}
+
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var r io.ReadSeeker = file
+	if image, err := readVDI(file); err == nil {
+		r = io.NewSectionReader(image, 0, int64(image.header.DiskSize))
+	} else if err != ErrNotVDI {
+		file.Close()
+		return nil, nil, nil, err
+	}
+
+	table, err := readPartitions(r, descriptorSectorSize)
+	if err != nil {
+		file.Close()
+		return nil, nil, nil, fmt.Errorf("Failed to read GPT or MBR table: %s", err.Error())
+	}
+
+	return r, table, file, nil
+}
@@ -0,0 +1,53 @@
+package vmdk
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	exposeReadWrite = iota
+	exposeReadOnly
+	exposeHidden
+)
+
+// PartitionPolicy selects which partitions are exposed to the guest and
+// how. Partitions are designated by their index, GPT partition GUID, GPT
+// type GUID or label.
+type PartitionPolicy struct {
+	// Include restricts the exposed partitions to the ones listed, if set
+	Include []string
+	// ReadOnly lists the partitions exposed read-only
+	ReadOnly []string
+	// Hide lists the partitions replaced by zeroes
+	Hide []string
+}
+
+func (p partition) matches(keys []string) bool {
+	for _, key := range keys {
+		switch {
+		case key == strconv.Itoa(p.Index):
+			return true
+		case p.GUID != "" && strings.EqualFold(key, p.GUID):
+			return true
+		case p.TypeGUID != "" && strings.EqualFold(key, p.TypeGUID):
+			return true
+		case p.Label != "" && key == p.Label:
+			return true
+		}
+	}
+	return false
+}
+
+// exposure returns how the partition is exposed to the guest
+func (policy PartitionPolicy) exposure(p partition) int {
+	if p.matches(policy.Hide) || (len(policy.Include) > 0 && !p.matches(policy.Include)) {
+		return exposeHidden
+	}
+
+	if p.matches(policy.ReadOnly) {
+		return exposeReadOnly
+	}
+
+	return exposeReadWrite
+}
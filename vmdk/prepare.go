@@ -0,0 +1,156 @@
+package vmdk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/lebauce/vlaunch/backend"
+)
+
+// Volume is a partition holding a filesystem
+type Volume struct {
+	Index int
+	// Offset is the position of the partition on the device, in bytes
+	Offset     uint64
+	Filesystem string
+	// UUID is the filesystem UUID, formatted like blkid does
+	UUID string
+}
+
+// FindVolume returns the partition of the device at index, or the first
+// partition holding a filesystem readable by all hosts if index is 0
+func FindVolume(deviceName string, index int) (*Volume, error) {
+	r, table, closer, err := openDisk(deviceName)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	data := make([]byte, alignUp(backend.ProbeSize, table.SectorSize))
+	for _, part := range table.Partitions {
+		if index != 0 && part.Index != index {
+			continue
+		}
+
+		if (part.LastLBA-part.FirstLBA+1)*table.SectorSize < uint64(len(data)) {
+			continue
+		}
+
+		if _, err := r.Seek(int64(part.FirstLBA*table.SectorSize), io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("Failed to read partition %d: %s", part.Index, err.Error())
+		}
+
+		filesystem := backend.DetectFilesystem(data)
+		switch {
+		case filesystem == "":
+			continue
+		case index == 0 && filesystem != "fat" && filesystem != "exfat" && filesystem != "ntfs":
+			continue
+		}
+
+		return &Volume{
+			Index:      part.Index,
+			Offset:     part.FirstLBA * table.SectorSize,
+			Filesystem: filesystem,
+			UUID:       backend.FilesystemUUID(data, filesystem),
+		}, nil
+	}
+
+	if index != 0 {
+		return nil, fmt.Errorf("No filesystem found on partition %d of %s", index, deviceName)
+	}
+	return nil, fmt.Errorf("No FAT, exFAT or NTFS partition found on %s", deviceName)
+}
+
+// WriteImage writes the raw disk image or VDI at location to the device,
+// then reads the device back to verify it. progress is called after each
+// chunk with the name of the pass and the number of bytes processed.
+func WriteImage(location string, deviceName string, progress func(pass string, done, total uint64)) error {
+	content, size, closer, err := openTemplate(location)
+	if err != nil {
+		return fmt.Errorf("Failed to open image %s: %s", location, err.Error())
+	}
+	defer closer.Close()
+
+	deviceSize, err := backend.GetDeviceSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	if size > deviceSize {
+		return fmt.Errorf("Image needs %d bytes, %s only has %d bytes", size, deviceName, deviceSize)
+	}
+
+	dev, err := backend.OpenDevice(deviceName, os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("Failed to open device: %s", err.Error())
+	}
+	defer dev.Close()
+
+	// Chunks are sector aligned, padding the end of the image if needed
+	data := make([]byte, backupBufferSize)
+	read := make([]byte, backupBufferSize)
+	padded := alignUp(size, descriptorSectorSize)
+
+	for _, pass := range []string{"write", "verify"} {
+		if pass == "verify" {
+			if syncer, ok := dev.(interface {
+				Sync() error
+			}); ok {
+				if err := syncer.Sync(); err != nil {
+					return err
+				}
+			}
+
+			// Read the media back rather than the cache the write pass
+			// filled
+			if err := backend.InvalidateCache(deviceName); err != nil {
+				return fmt.Errorf("Failed to invalidate the cache of %s: %s", deviceName, err.Error())
+			}
+		}
+
+		if _, err := dev.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		for done := uint64(0); done < padded; {
+			chunk := data
+			if padded-done < uint64(len(chunk)) {
+				chunk = chunk[:padded-done]
+			}
+
+			n, err := content.ReadAt(chunk, int64(done))
+			if err != nil && err != io.EOF {
+				return fmt.Errorf("Failed to read image: %s", err.Error())
+			}
+			for i := n; i < len(chunk); i++ {
+				chunk[i] = 0
+			}
+
+			if pass == "write" {
+				if _, err := dev.Write(chunk); err != nil {
+					return fmt.Errorf("Failed to write at offset %d: %s", done, err.Error())
+				}
+			} else {
+				if _, err := io.ReadFull(dev, read[:len(chunk)]); err != nil {
+					return fmt.Errorf("Failed to read back at offset %d: %s", done, err.Error())
+				}
+				if !bytes.Equal(chunk, read[:len(chunk)]) {
+					return fmt.Errorf("Verification failed at offset %d", done)
+				}
+			}
+
+			done += uint64(len(chunk))
+			if progress != nil {
+				progress(pass, done, padded)
+			}
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package vmdk
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"os"
@@ -12,38 +13,58 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/lebauce/vlaunch/backend"
-	"github.com/rekby/gpt"
-	"github.com/rekby/mbr"
 )
 
-var blockSize uint64 = 512
+// descriptorSectorSize is the unit of the extent sizes and offsets in
+// descriptors, whatever the sector size of the device
+const descriptorSectorSize = 512
+
 var headerTemplate = `# Disk DescriptorFile
 version=1
-CID=8902101c
+{{if .Encoding}}encoding="{{.Encoding}}"
+{{end}}CID={{.CID}}
 parentCID=ffffffff
 createType="{{.Type}}"
 {{range .Extents}}{{.AccessMode}} {{.Size}} {{.Type}}{{if .Path}} "{{.Path}}"{{end}}{{if eq .Type "FLAT"}} {{.Offset}}{{end}}
-{{end}}ddb.virtualHWVersion = "4"
-ddb.adapterType="ide"
-ddb.geometry.cylinders="{{.Cylinders}}"
-ddb.geometry.heads="16"
-ddb.geometry.sectors="63"
-ddb.geometry.biosCylinders="{{.Cylinders}}"
-ddb.geometry.biosHeads="16"
-ddb.geometry.biosSectors="63"
+{{end}}ddb.virtualHWVersion = "{{.HWVersion}}"
+ddb.adapterType="{{.AdapterType}}"
+ddb.geometry.cylinders="{{.Geometry.Cylinders}}"
+ddb.geometry.heads="{{.Geometry.Heads}}"
+ddb.geometry.sectors="{{.Geometry.Sectors}}"
+ddb.geometry.biosCylinders="{{.BIOSGeometry.Cylinders}}"
+ddb.geometry.biosHeads="{{.BIOSGeometry.Heads}}"
+ddb.geometry.biosSectors="{{.BIOSGeometry.Sectors}}"
 ddb.uuid.image="{{.UUID}}"
 ddb.uuid.parent="00000000-0000-0000-0000-000000000000"
-ddb.uuid.modification="b0004a36-2323-433e-9bbc-103368bc5e41"
-ddb.uuid.parentmodification="00000000-0000-0000-0000-000000000000"`
+ddb.uuid.modification="{{.ModificationUUID}}"
+ddb.uuid.parentmodification="00000000-0000-0000-0000-000000000000"{{if ne .LogicalSectorSize 512}}
+ddb.logicalSectorSize="{{.LogicalSectorSize}}"
+ddb.physicalSectorSize="{{.PhysicalSectorSize}}"{{end}}`
+
+// uuidNamespace is the namespace of the UUIDs derived from the identity
+// of the devices
+var uuidNamespace = uuid.Must(uuid.Parse("1b6a4c1e-6c1f-4b44-9a5a-3f0b8e0f7d21"))
 
 type rawVMDK struct {
-	UUID       uuid.UUID
-	TargetPath string
-	DeviceName string
-	DeviceSize uint64
-	Type       string
-	Cylinders  uint64
-	Extents    []extent
+	UUID               uuid.UUID
+	ModificationUUID   uuid.UUID
+	CID                string
+	TargetPath         string
+	DeviceName         string
+	DeviceSize         uint64
+	LogicalSectorSize  uint64
+	PhysicalSectorSize uint64
+	Type               string
+	Encoding           string
+	HWVersion          string
+	AdapterType        string
+	Geometry           geometry
+	BIOSGeometry       geometry
+	Extents            []extent
+	// DDB holds the ddb.* keys of a parsed descriptor, without the prefix
+	DDB map[string]string
+	// readOnly makes the whole QEMU blockdev read-only
+	readOnly bool
 }
 
 type extent struct {
@@ -54,149 +75,282 @@ type extent struct {
 	Offset     uint64
 }
 
-type partition struct {
-	FirstLBA uint64
-	LastLBA  uint64
+// headerLocation returns the location of the file holding the copy of
+// the blocks before the first partition
+func headerLocation(location string) string {
+	return strings.TrimSuffix(location, path.Ext(location)) + "-pt.vmdk"
 }
 
-func readPartitions(r io.ReadSeeker) ([]partition, error) {
-	var parts []partition
+// trailerLocation returns the location of the file holding the copy of
+// the backup GPT structures at the end of the device
+func trailerLocation(location string) string {
+	return strings.TrimSuffix(location, path.Ext(location)) + "-gpt.vmdk"
+}
 
-	r.Seek(512, io.SeekStart)
-	table, err := gpt.ReadTable(r, blockSize)
-	if err == nil {
-		for _, part := range table.Partitions {
-			if !part.IsEmpty() {
-				parts = append(parts, partition{FirstLBA: part.FirstLBA, LastLBA: part.LastLBA})
-			}
-		}
-		return parts, nil
+// ebrLocation returns the location of the file holding the copy of the
+// extended boot records areas
+func ebrLocation(location string) string {
+	return strings.TrimSuffix(location, path.Ext(location)) + "-ebr.vmdk"
+}
+
+// descriptorSectors converts a number of sectors of sectorSize bytes to
+// a number of descriptor sectors
+func descriptorSectors(count uint64, sectorSize uint64) uint64 {
+	return count * sectorSize / descriptorSectorSize
+}
+
+// copySectors copies count sectors of the device starting at sector first
+// to w
+func copySectors(dev backend.DeviceFile, w io.Writer, sectorSize, first, count uint64) error {
+	if _, err := dev.Seek(int64(first*sectorSize), io.SeekStart); err != nil {
+		return err
 	}
 
-	r.Seek(0, io.SeekStart)
-	mbr, err := mbr.Read(r)
+	_, err := io.CopyN(w, dev, int64(count*sectorSize))
+	return err
+}
+
+// copyDeviceRange copies count sectors of the device starting at sector
+// first to the file at location
+func copyDeviceRange(dev backend.DeviceFile, location string, sectorSize, first, count uint64) error {
+	file, err := os.Create(location)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for _, part := range mbr.GetAllPartitions() {
-		if !part.IsEmpty() {
-			parts = append(parts, partition{FirstLBA: uint64(part.GetLBAStart()), LastLBA: uint64(part.GetLBALast())})
-		}
+
+	err = copySectors(dev, file, sectorSize, first, count)
+	file.Close()
+	if err != nil {
+		return err
 	}
 
-	return parts, nil
+	log.Printf("Copied %d bytes to %s\n", int64(count*sectorSize), location)
+	return nil
 }
 
-func CreateRawVMDK(location string, deviceName string, partitions bool, relative bool) error {
+// deviceUUID derives a stable image UUID from the identity of the device,
+// its serial number or the GUID of its GPT
+func deviceUUID(deviceName string, table *partitionTable) uuid.UUID {
+	if serial, err := backend.GetDeviceSerial(deviceName); err == nil {
+		return uuid.NewSHA1(uuidNamespace, []byte("serial:"+serial))
+	}
+
+	if table != nil && table.DiskGUID != "" {
+		return uuid.NewSHA1(uuidNamespace, []byte("gpt:"+table.DiskGUID))
+	}
+
+	log.Printf("Could not identify %s, using a random UUID\n", deviceName)
+	return uuid.New()
+}
+
+// setLayoutIdentifiers sets the content ID and the modification UUID of
+// the descriptor. Both only change when the layout of the extents changes.
+func (vmdk *rawVMDK) setLayoutIdentifiers() {
+	var layout bytes.Buffer
+	for _, e := range vmdk.Extents {
+		fmt.Fprintf(&layout, "%s %d %s %s %d\n", e.AccessMode, e.Size, e.Type, e.Path, e.Offset)
+	}
+
+	vmdk.CID = fmt.Sprintf("%08x", crc32.ChecksumIEEE(layout.Bytes()))
+	vmdk.ModificationUUID = uuid.NewSHA1(vmdk.UUID, layout.Bytes())
+}
+
+// RawOptions controls how CreateRawVMDK maps the device
+type RawOptions struct {
+	// Partitions maps the partitions individually instead of the whole device
+	Partitions bool
+	// Relative uses the partition device nodes instead of offsets in the device
+	Relative bool
+	// ReadOnly marks all the extents as read-only, for use as an immutable base
+	ReadOnly bool
+	// UUID is the image UUID. It is derived from the device identity if
+	// not set
+	UUID uuid.UUID
+	// Policy selects the partitions exposed to the guest
+	Policy PartitionPolicy
+	// Output selects the flavor of the descriptor
+	Output OutputOptions
+}
+
+func CreateRawVMDK(location string, deviceName string, opts RawOptions) error {
 	deviceSize, err := backend.GetDeviceSize(deviceName)
 	if err != nil {
 		return err
 	}
 
-	cylinders := deviceSize / 16 / 64
-	if cylinders > 16383 {
-		cylinders = 16383
+	logicalSectorSize, physicalSectorSize, err := backend.GetSectorSize(deviceName)
+	if err != nil {
+		return err
+	}
+
+	accessMode := "RW"
+	if opts.ReadOnly {
+		accessMode = "RDONLY"
 	}
 
 	vmdk := rawVMDK{
-		UUID:       uuid.New(),
-		DeviceName: deviceName,
-		DeviceSize: deviceSize,
-		Cylinders:  cylinders,
+		UUID:               opts.UUID,
+		DeviceName:         deviceName,
+		DeviceSize:         deviceSize,
+		LogicalSectorSize:  logicalSectorSize,
+		PhysicalSectorSize: physicalSectorSize,
+	}
+
+	// Partition tables are expressed in logical sectors, while descriptors
+	// always use 512 bytes sectors
+	sectors := func(count uint64) uint64 {
+		return descriptorSectors(count, logicalSectorSize)
 	}
 
-	if partitions {
+	if opts.Partitions {
 		dev, err := backend.OpenDevice(deviceName, os.O_RDONLY)
 		if err != nil {
 			return fmt.Errorf("Failed to open device: %s", err.Error())
 		}
 		defer dev.Close()
 
-		// For some reason, passing directly the device to gpt.ReadTable
-		// doesn't work on Windows. So we read the beginning and pass it to
-		// gpt.ReadTable.
-		data := make([]byte, 32768)
-		if _, err := dev.Read(data); err != nil {
-			return fmt.Errorf("Failed to read: %s", err.Error())
+		table, err := readDevicePartitions(dev, logicalSectorSize)
+		if err != nil {
+			return err
 		}
 
-		firstBlocks := bytes.NewReader(data)
-
-		partitions, err := readPartitions(firstBlocks)
-		if err != nil {
-			return fmt.Errorf("Failed to read GPT or MBR table: %s", err.Error())
+		if vmdk.UUID == uuid.Nil {
+			vmdk.UUID = deviceUUID(deviceName, table)
 		}
 
-		offset := partitions[0].FirstLBA
-		headerPath := strings.TrimSuffix(location, path.Ext(location)) + "-pt.vmdk"
-		deviceHeader, err := os.Create(headerPath)
+		regions, err := planLayout(table, deviceSize, opts.Policy)
 		if err != nil {
-			return err
+			return fmt.Errorf("Invalid partition table on %s: %s", deviceName, err.Error())
 		}
 
-		multiReader := io.MultiReader(bytes.NewReader(data), dev)
-		_, err = io.CopyN(deviceHeader, multiReader, int64(offset*blockSize))
-		deviceHeader.Close()
-		if err != nil {
-			return err
+		var partitionDevices map[uint64]string
+		if opts.Relative {
+			if partitionDevices, err = backend.GetPartitionDevices(deviceName); err != nil {
+				return fmt.Errorf("Failed to list partitions of %s: %s", deviceName, err.Error())
+			}
 		}
 
-		log.Printf("Copied %d bytes to %s\n", int64(offset*blockSize), headerPath)
+		// In relative mode, there is no device node for the extended boot
+		// records, so the EBR areas are copied to a file
+		var ebrFile *os.File
+		var ebrOffset uint64
+		ebrPath := ebrLocation(location)
+		os.Remove(ebrPath)
 
-		header := extent{AccessMode: "RW", Size: offset, Type: "FLAT", Path: path.Base(headerPath)}
 		vmdk.Type = "partitionedDevice"
-		vmdk.Extents = append(vmdk.Extents, header)
-
-		for i, part := range partitions {
-			if part.FirstLBA > offset {
-				vmdk.Extents = append(vmdk.Extents, extent{
-					AccessMode: "RW",
-					Size:       part.FirstLBA - offset,
-					Type:       "ZERO",
-				})
-			}
-
-			size := part.LastLBA - part.FirstLBA + 1
+		for _, r := range regions {
 			newExtent := extent{
-				AccessMode: "RW",
-				Size:       size,
+				AccessMode: accessMode,
+				Size:       sectors(r.Sectors),
 				Type:       "FLAT",
-				Offset:     part.FirstLBA,
+				Offset:     sectors(r.FirstLBA),
 				Path:       deviceName,
 			}
 
-			if relative {
-				newExtent.Path = fmt.Sprintf("%s%d", deviceName, i+1)
+			if r.ReadOnly {
+				newExtent.AccessMode = "RDONLY"
+			}
+
+			switch r.Kind {
+			case regionZero:
+				if r.Partition.Index != 0 {
+					log.Printf("Hiding partition %d\n", r.Partition.Index)
+				}
+				newExtent = extent{AccessMode: accessMode, Size: sectors(r.Sectors), Type: "ZERO"}
+			case regionHeader:
+				headerPath := headerLocation(location)
+				if err := copyDeviceRange(dev, headerPath, logicalSectorSize, r.FirstLBA, r.Sectors); err != nil {
+					return err
+				}
+				newExtent.Path = path.Base(headerPath)
+				newExtent.Offset = 0
+			case regionBackupGPT:
+				trailerPath := trailerLocation(location)
+				if err := copyDeviceRange(dev, trailerPath, logicalSectorSize, r.FirstLBA, r.Sectors); err != nil {
+					return fmt.Errorf("Failed to copy backup GPT: %s", err.Error())
+				}
+				newExtent.Path = path.Base(trailerPath)
+				newExtent.Offset = 0
+			case regionEBR:
+				if !opts.Relative {
+					break
+				}
+
+				if ebrFile == nil {
+					if ebrFile, err = os.Create(ebrPath); err != nil {
+						return err
+					}
+					defer ebrFile.Close()
+				}
+
+				if err := copySectors(dev, ebrFile, logicalSectorSize, r.FirstLBA, r.Sectors); err != nil {
+					return fmt.Errorf("Failed to copy EBR at sector %d: %s", r.FirstLBA, err.Error())
+				}
+
+				newExtent.Path = path.Base(ebrPath)
+				newExtent.Offset = ebrOffset
+				ebrOffset += sectors(r.Sectors)
+			case regionPartition:
+				if r.ReadOnly {
+					log.Printf("Exposing partition %d read-only\n", r.Partition.Index)
+				}
+
+				if !opts.Relative {
+					break
+				}
+
+				// Partition devices are matched by their start sector
+				partitionDevice, found := partitionDevices[r.FirstLBA*logicalSectorSize/512]
+				if !found {
+					return fmt.Errorf("Could not find device for partition %d of %s", r.Partition.Index, deviceName)
+				}
+				newExtent.Path = partitionDevice
 				newExtent.Offset = 0
 			}
 
 			vmdk.Extents = append(vmdk.Extents, newExtent)
-			offset += size
 		}
-
-		vmdk.Extents = append(vmdk.Extents, extent{
-			AccessMode: "RW",
-			Size:       (deviceSize / 512) - offset,
-			Type:       "ZERO",
-		})
 	} else {
 		vmdk.Type = "fullDevice"
 		vmdk.Extents = []extent{
-			extent{AccessMode: "RW", Size: deviceSize, Type: "FLAT", Path: deviceName},
+			extent{AccessMode: accessMode, Size: deviceSize / descriptorSectorSize, Type: "FLAT", Path: deviceName},
 		}
 	}
 
+	if vmdk.UUID == uuid.Nil {
+		vmdk.UUID = deviceUUID(deviceName, nil)
+	}
+
+	return vmdk.write(location, opts.Output)
+}
+
+// render writes the descriptor to w in the output format
+func (vmdk *rawVMDK) render(w io.Writer, out OutputOptions) error {
+	if err := vmdk.setOutput(out); err != nil {
+		return err
+	}
+
+	vmdk.setLayoutIdentifiers()
+
 	t := template.Must(template.New("VMDK").Parse(headerTemplate))
+	return t.Execute(w, vmdk)
+}
 
+// write writes the descriptor to location in the output format
+func (vmdk *rawVMDK) write(location string, out OutputOptions) error {
 	file, err := os.Create(location)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	if err := t.Execute(file, vmdk); err != nil {
+	if err := vmdk.render(file, out); err != nil {
 		return err
 	}
 
+	if out.Format == FormatQEMU {
+		return vmdk.writeBlockdev(location)
+	}
+
 	return nil
 }
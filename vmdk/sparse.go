@@ -0,0 +1,304 @@
+package vmdk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	sparseMagic = 0x564d444b // KDMV
+	// sparseGrainSize is the number of sectors of a grain
+	sparseGrainSize = 128
+	// sparseGTEntries is the number of entries of a grain table
+	sparseGTEntries = 512
+	// sparseDescriptorSectors is the room left for the embedded descriptor
+	sparseDescriptorSectors = 20
+)
+
+// sparseExtentHeader is the header of hosted sparse extents
+type sparseExtentHeader struct {
+	MagicNumber        uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  byte
+	NonEndLineChar     byte
+	DoubleEndLineChar1 byte
+	DoubleEndLineChar2 byte
+	CompressAlgorithm  uint16
+	Pad                [433]byte
+}
+
+// sparseImage is a dynamically allocated image being written
+type sparseImage interface {
+	blockSize() uint64
+	writeBlock(index uint64, data []byte) error
+	Close() error
+}
+
+// sparseWriter writes a monolithicSparse VMDK. All the grain tables are
+// allocated upfront and grains are appended in the order they are written.
+type sparseWriter struct {
+	file        *os.File
+	location    string
+	header      sparseExtentHeader
+	grainTables []uint32
+	nextGrain   uint64
+}
+
+func alignUp(value, alignment uint64) uint64 {
+	return (value + alignment - 1) / alignment * alignment
+}
+
+func allZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func createSparseVMDK(location string, size uint64) (*sparseWriter, error) {
+	capacity := alignUp(size, descriptorSectorSize) / descriptorSectorSize
+	grains := (capacity + sparseGrainSize - 1) / sparseGrainSize
+	grainTables := (grains + sparseGTEntries - 1) / sparseGTEntries
+
+	gdOffset := uint64(1 + sparseDescriptorSectors)
+	gdSectors := alignUp(grainTables*4, descriptorSectorSize) / descriptorSectorSize
+	gtSectors := grainTables * sparseGTEntries * 4 / descriptorSectorSize
+	overHead := alignUp(gdOffset+gdSectors+gtSectors, sparseGrainSize)
+
+	w := &sparseWriter{
+		location: location,
+		header: sparseExtentHeader{
+			MagicNumber: sparseMagic,
+			Version:     1,
+			// Valid new line detection test
+			Flags:              1,
+			Capacity:           capacity,
+			GrainSize:          sparseGrainSize,
+			DescriptorOffset:   1,
+			DescriptorSize:     sparseDescriptorSectors,
+			NumGTEsPerGT:       sparseGTEntries,
+			GDOffset:           gdOffset,
+			OverHead:           overHead,
+			SingleEndLineChar:  '\n',
+			NonEndLineChar:     ' ',
+			DoubleEndLineChar1: '\r',
+			DoubleEndLineChar2: '\n',
+		},
+		grainTables: make([]uint32, grainTables*sparseGTEntries),
+		nextGrain:   overHead,
+	}
+
+	file, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+
+	return w, nil
+}
+
+func (w *sparseWriter) blockSize() uint64 {
+	return sparseGrainSize * descriptorSectorSize
+}
+
+func (w *sparseWriter) writeBlock(index uint64, data []byte) error {
+	if _, err := w.file.WriteAt(data, int64(w.nextGrain*descriptorSectorSize)); err != nil {
+		return err
+	}
+
+	w.grainTables[index] = uint32(w.nextGrain)
+	w.nextGrain += sparseGrainSize
+	return nil
+}
+
+// Close writes the header, the embedded descriptor, the grain directory
+// and the grain tables, and closes the file
+func (w *sparseWriter) Close() error {
+	defer w.file.Close()
+
+	if err := w.file.Truncate(int64(w.nextGrain * descriptorSectorSize)); err != nil {
+		return err
+	}
+
+	vmdk := rawVMDK{
+		UUID:               uuid.New(),
+		DeviceSize:         w.header.Capacity * descriptorSectorSize,
+		LogicalSectorSize:  descriptorSectorSize,
+		PhysicalSectorSize: descriptorSectorSize,
+		Type:               "monolithicSparse",
+		Extents: []extent{
+			{AccessMode: "RW", Size: w.header.Capacity, Type: "SPARSE", Path: path.Base(w.location)},
+		},
+	}
+
+	var descriptor bytes.Buffer
+	if err := vmdk.render(&descriptor, OutputOptions{}); err != nil {
+		return err
+	}
+
+	if descriptor.Len() > sparseDescriptorSectors*descriptorSectorSize {
+		return fmt.Errorf("Descriptor too large (%d bytes)", descriptor.Len())
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, &w.header); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Write(descriptor.Bytes()); err != nil {
+		return err
+	}
+
+	gtCount := uint64(len(w.grainTables)) / sparseGTEntries
+	gtOffset := w.header.GDOffset + alignUp(gtCount*4, descriptorSectorSize)/descriptorSectorSize
+	directory := make([]uint32, gtCount)
+	for i := range directory {
+		directory[i] = uint32(gtOffset + uint64(i)*sparseGTEntries*4/descriptorSectorSize)
+	}
+
+	if _, err := w.file.Seek(int64(w.header.GDOffset*descriptorSectorSize), io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, directory); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Seek(int64(gtOffset*descriptorSectorSize), io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, w.grainTables); err != nil {
+		return err
+	}
+
+	return w.file.Close()
+}
+
+// openTemplate opens the template image at location, either a VDI or a
+// raw disk image, and returns a reader of its content and its size
+func openTemplate(location string) (io.ReaderAt, uint64, io.Closer, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	image, err := readVDI(file)
+	switch {
+	case err == nil:
+		if image.header.Type == vdiImageTypeDiff {
+			file.Close()
+			return nil, 0, nil, fmt.Errorf("%s is a differencing image", location)
+		}
+		return image, image.header.DiskSize, file, nil
+	case err != ErrNotVDI:
+		file.Close()
+		return nil, 0, nil, err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, nil, err
+	}
+
+	return file, uint64(fi.Size()), file, nil
+}
+
+// CreateSparseDisk creates a dynamically allocated disk of size bytes at
+// location, as a VDI or a monolithicSparse VMDK depending on its extension.
+// If template is set, the disk is seeded with the content of this VDI or
+// raw image, and grown to its size if needed.
+func CreateSparseDisk(location string, size uint64, template string) error {
+	var (
+		content      io.ReaderAt
+		templateSize uint64
+	)
+
+	if template != "" {
+		reader, readerSize, closer, err := openTemplate(template)
+		if err != nil {
+			return fmt.Errorf("Failed to open template %s: %s", template, err.Error())
+		}
+		defer closer.Close()
+
+		if readerSize > size {
+			log.Printf("Growing disk to the size of template %s (%d bytes)\n", template, readerSize)
+			size = readerSize
+		}
+		content, templateSize = reader, readerSize
+	}
+
+	if size == 0 {
+		return fmt.Errorf("No size specified for disk %s", location)
+	}
+
+	var (
+		image sparseImage
+		err   error
+	)
+
+	switch ext := strings.ToLower(path.Ext(location)); ext {
+	case ".vdi":
+		image, err = createVDI(location, size)
+	case ".vmdk":
+		image, err = createSparseVMDK(location, size)
+	default:
+		return fmt.Errorf("Unsupported disk format '%s'", ext)
+	}
+	if err != nil {
+		return err
+	}
+
+	blockSize := image.blockSize()
+	data := make([]byte, blockSize)
+	for index := uint64(0); index*blockSize < templateSize; index++ {
+		n, err := content.ReadAt(data, int64(index*blockSize))
+		if err != nil && err != io.EOF {
+			image.Close()
+			os.Remove(location)
+			return fmt.Errorf("Failed to read template %s: %s", template, err.Error())
+		}
+
+		for i := n; i < len(data); i++ {
+			data[i] = 0
+		}
+
+		if allZero(data) {
+			continue
+		}
+
+		if err := image.writeBlock(index, data); err != nil {
+			image.Close()
+			os.Remove(location)
+			return err
+		}
+	}
+
+	if err := image.Close(); err != nil {
+		os.Remove(location)
+		return err
+	}
+
+	log.Printf("Created disk %s of %d bytes\n", location, size)
+	return nil
+}
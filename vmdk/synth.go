@@ -0,0 +1,251 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"unicode/utf16"
+
+	"github.com/google/uuid"
+	"github.com/lebauce/vlaunch/backend"
+	"github.com/rekby/gpt"
+)
+
+const (
+	// synthFirstLBA is where the partition starts on synthetic disks,
+	// aligned on 1 MiB
+	synthFirstLBA = 2048
+	// gptEntries is the number of entries of the synthetic GPT
+	gptEntries = 128
+	// gptEntrySize is the size of the entries of the synthetic GPT
+	gptEntrySize = 128
+	// gptArraySectors is the number of sectors of the partition array
+	gptArraySectors = gptEntries * gptEntrySize / descriptorSectorSize
+)
+
+// linuxFilesystemGUID is the GPT type of Linux filesystem data partitions
+const linuxFilesystemGUID = "0FC63DAF-8483-4772-8E79-3D69D8477DE4"
+
+// SyntheticOptions controls how CreatePartitionVMDK builds the disk
+type SyntheticOptions struct {
+	// GPT uses a GUID partition table instead of an MBR. It is forced
+	// for partitions that an MBR cannot address.
+	GPT bool
+	// MBRType is the MBR partition type, Linux (0x83) if not set
+	MBRType byte
+	// TypeGUID is the GPT partition type, Linux filesystem if not set
+	TypeGUID string
+	// Label is the GPT partition name
+	Label string
+	// ReadOnly exposes the partition read-only
+	ReadOnly bool
+	// UUID is the image UUID. It is derived from the source if not set
+	UUID uuid.UUID
+	// Output selects the flavor of the descriptor
+	Output OutputOptions
+}
+
+// sectorBuffer is an in-memory io.WriteSeeker holding the sectors of a
+// disk starting at sector first
+type sectorBuffer struct {
+	first uint64
+	data  []byte
+	pos   int64
+}
+
+func (b *sectorBuffer) Write(p []byte) (int, error) {
+	offset := b.pos - int64(b.first*descriptorSectorSize)
+	if offset < 0 || offset+int64(len(p)) > int64(len(b.data)) {
+		return 0, errors.New("Write outside of the buffer")
+	}
+
+	n := copy(b.data[offset:], p)
+	b.pos += int64(n)
+	return n, nil
+}
+
+func (b *sectorBuffer) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekStart {
+		return b.pos, errors.New("Unsupported seek")
+	}
+	b.pos = offset
+	return b.pos, nil
+}
+
+// sourceSize returns the size of the partition device or image file
+func sourceSize(source string) (uint64, error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+
+	if fi.Mode().IsRegular() {
+		return uint64(fi.Size()), nil
+	}
+
+	return backend.GetDeviceSize(source)
+}
+
+// mbrEntry writes a partition entry that is only addressed in LBA
+func mbrEntry(entry []byte, bootable bool, partType byte, first, count uint64) {
+	if bootable {
+		entry[0] = 0x80
+	}
+	copy(entry[1:4], []byte{0xfe, 0xff, 0xff})
+	entry[4] = partType
+	copy(entry[5:8], []byte{0xfe, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(entry[8:12], uint32(first))
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(count))
+}
+
+// CreatePartitionVMDK creates at location a descriptor for a disk that only
+// contains the partition device or filesystem image at source. The
+// partition table is synthesized in header files, next to the descriptor.
+// As the MBR holds no boot code, the partition must be booted by the
+// firmware, from its own boot sector or an EFI loader.
+func CreatePartitionVMDK(location string, source string, opts SyntheticOptions) error {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+
+	size, err := sourceSize(source)
+	if err != nil {
+		return err
+	}
+
+	if size == 0 || size%descriptorSectorSize != 0 {
+		return fmt.Errorf("Size of %s (%d) is not a multiple of %d", source, size, descriptorSectorSize)
+	}
+
+	partSectors := size / descriptorSectorSize
+	useGPT := opts.GPT || synthFirstLBA+partSectors > 0xffffffff
+
+	totalSectors := synthFirstLBA + partSectors
+	if useGPT {
+		totalSectors += gptArraySectors + 1
+	}
+
+	accessMode := "RW"
+	if opts.ReadOnly {
+		accessMode = "RDONLY"
+	}
+
+	vmdk := rawVMDK{
+		UUID:               opts.UUID,
+		DeviceName:         source,
+		DeviceSize:         totalSectors * descriptorSectorSize,
+		LogicalSectorSize:  descriptorSectorSize,
+		PhysicalSectorSize: descriptorSectorSize,
+		Type:               "partitionedDevice",
+	}
+
+	if vmdk.UUID == uuid.Nil {
+		vmdk.UUID = uuid.NewSHA1(uuidNamespace, []byte("partition:"+source))
+	}
+
+	header := &sectorBuffer{data: make([]byte, synthFirstLBA*descriptorSectorSize)}
+	mbr := header.data[:descriptorSectorSize]
+	copy(mbr[440:444], vmdk.UUID[:4])
+	mbr[510], mbr[511] = 0x55, 0xaa
+
+	var trailer *sectorBuffer
+	if useGPT {
+		typeGUID := opts.TypeGUID
+		if typeGUID == "" {
+			typeGUID = linuxFilesystemGUID
+		}
+
+		partType, err := uuid.Parse(typeGUID)
+		if err != nil {
+			return fmt.Errorf("Invalid partition type '%s': %s", typeGUID, err.Error())
+		}
+
+		// Protective MBR covering the whole disk
+		protectiveSectors := totalSectors - 1
+		if protectiveSectors > 0xffffffff {
+			protectiveSectors = 0xffffffff
+		}
+		mbrEntry(mbr[446:462], false, 0xee, 1, protectiveSectors)
+
+		table := gpt.Table{
+			SectorSize: descriptorSectorSize,
+			Header: gpt.Header{
+				Revision:                0x00010000,
+				Size:                    92,
+				HeaderStartLBA:          1,
+				HeaderCopyStartLBA:      totalSectors - 1,
+				FirstUsableLBA:          2 + gptArraySectors,
+				LastUsableLBA:           totalSectors - gptArraySectors - 2,
+				DiskGUID:                gpt.Guid(mixedEndianUUID(vmdk.UUID)),
+				PartitionsTableStartLBA: 2,
+				PartitionsArrLen:        gptEntries,
+				PartitionEntrySize:      gptEntrySize,
+				TrailingBytes:           make([]byte, descriptorSectorSize-92),
+			},
+			Partitions: make([]gpt.Partition, gptEntries),
+		}
+		copy(table.Header.Signature[:], "EFI PART")
+
+		part := &table.Partitions[0]
+		part.Type = gpt.PartType(mixedEndianUUID(partType))
+		part.Id = gpt.Guid(mixedEndianUUID(uuid.NewSHA1(vmdk.UUID, []byte("partition"))))
+		part.FirstLBA = synthFirstLBA
+		part.LastLBA = synthFirstLBA + partSectors - 1
+		for i, c := range utf16.Encode([]rune(opts.Label)) {
+			if 2*i+1 >= len(part.PartNameUTF16) {
+				break
+			}
+			binary.LittleEndian.PutUint16(part.PartNameUTF16[2*i:], c)
+		}
+
+		if err := table.Write(header); err != nil {
+			return fmt.Errorf("Failed to write GPT: %s", err.Error())
+		}
+
+		trailer = &sectorBuffer{
+			first: totalSectors - gptArraySectors - 1,
+			data:  make([]byte, (gptArraySectors+1)*descriptorSectorSize),
+		}
+		if err := table.CreateOtherSideTable().Write(trailer); err != nil {
+			return fmt.Errorf("Failed to write backup GPT: %s", err.Error())
+		}
+	} else {
+		partType := opts.MBRType
+		if partType == 0 {
+			partType = 0x83
+		}
+		mbrEntry(mbr[446:462], true, partType, synthFirstLBA, partSectors)
+	}
+
+	headerPath := headerLocation(location)
+	if err := ioutil.WriteFile(headerPath, header.data, 0644); err != nil {
+		return err
+	}
+
+	vmdk.Extents = []extent{
+		{AccessMode: accessMode, Size: synthFirstLBA, Type: "FLAT", Path: path.Base(headerPath)},
+		{AccessMode: accessMode, Size: partSectors, Type: "FLAT", Path: source},
+	}
+
+	if trailer != nil {
+		trailerPath := trailerLocation(location)
+		if err := ioutil.WriteFile(trailerPath, trailer.data, 0644); err != nil {
+			return err
+		}
+
+		vmdk.Extents = append(vmdk.Extents, extent{
+			AccessMode: accessMode,
+			Size:       gptArraySectors + 1,
+			Type:       "FLAT",
+			Path:       path.Base(trailerPath),
+		})
+	}
+
+	return vmdk.write(location, opts.Output)
+}
@@ -0,0 +1,285 @@
+package vmdk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+const (
+	vdiSignature     = 0xbeda107f
+	vdiVersion       = 0x00010001
+	vdiPreHeaderSize = 72
+	vdiHeaderSize    = 400
+	vdiInfo          = "<<< Oracle VM VirtualBox Disk Image >>>\n"
+
+	// vdiBlockSize and vdiDataAlign are the values used by VirtualBox
+	vdiBlockSize = 1 << 20
+	vdiDataAlign = 1 << 20
+
+	vdiImageTypeNormal = 1
+	vdiImageTypeFixed  = 2
+	vdiImageTypeDiff   = 4
+
+	vdiBlockFree = 0xffffffff
+	vdiBlockZero = 0xfffffffe
+)
+
+var ErrNotVDI = errors.New("Not a VDI image")
+
+type vdiPreHeader struct {
+	Info      [64]byte
+	Signature uint32
+	Version   uint32
+}
+
+// vdiHeader is the 1.1 version of the VDI header, as written by VirtualBox
+type vdiHeader struct {
+	Size             uint32
+	Type             uint32
+	Flags            uint32
+	Comment          [256]byte
+	BlocksOffset     uint32
+	DataOffset       uint32
+	Cylinders        uint32
+	Heads            uint32
+	Sectors          uint32
+	SectorSize       uint32
+	Unused           uint32
+	DiskSize         uint64
+	BlockSize        uint32
+	BlockExtraSize   uint32
+	Blocks           uint32
+	BlocksAllocated  uint32
+	UUIDCreate       [16]byte
+	UUIDModify       [16]byte
+	UUIDLinkage      [16]byte
+	UUIDParentModify [16]byte
+	LCHSCylinders    uint32
+	LCHSHeads        uint32
+	LCHSSectors      uint32
+	LCHSSectorSize   uint32
+}
+
+type vdiImage struct {
+	r        io.ReadSeeker
+	header   vdiHeader
+	blockMap []uint32
+}
+
+// mixedEndianUUID converts an UUID as stored by VirtualBox or in GPTs,
+// with its first three fields in little endian, to its canonical form.
+// The conversion is its own inverse.
+func mixedEndianUUID(b [16]byte) uuid.UUID {
+	var u uuid.UUID
+	copy(u[:], b[:])
+	u[0], u[1], u[2], u[3] = b[3], b[2], b[1], b[0]
+	u[4], u[5] = b[5], b[4]
+	u[6], u[7] = b[7], b[6]
+	return u
+}
+
+func readVDI(r io.ReadSeeker) (*vdiImage, error) {
+	var preHeader vdiPreHeader
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Read(r, binary.LittleEndian, &preHeader); err != nil {
+		return nil, err
+	}
+
+	if preHeader.Signature != vdiSignature {
+		return nil, ErrNotVDI
+	}
+
+	if preHeader.Version>>16 != 1 {
+		return nil, fmt.Errorf("Unsupported VDI version %x", preHeader.Version)
+	}
+
+	image := &vdiImage{r: r}
+	if err := binary.Read(r, binary.LittleEndian, &image.header); err != nil {
+		return nil, err
+	}
+
+	if _, err := r.Seek(int64(image.header.BlocksOffset), io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	image.blockMap = make([]uint32, image.header.Blocks)
+	if err := binary.Read(r, binary.LittleEndian, image.blockMap); err != nil {
+		return nil, fmt.Errorf("Failed to read VDI block map: %s", err.Error())
+	}
+
+	return image, nil
+}
+
+// ParentUUID returns the UUID of the image the differencing image is based on
+func (v *vdiImage) ParentUUID() uuid.UUID {
+	return mixedEndianUUID(v.header.UUIDLinkage)
+}
+
+// readBlock reads the content of the virtual block at index. It returns
+// false if the block is not allocated in the image
+func (v *vdiImage) readBlock(index uint32, data []byte) (bool, error) {
+	offset := v.blockMap[index]
+	switch offset {
+	case vdiBlockFree:
+		return false, nil
+	case vdiBlockZero:
+		for i := range data {
+			data[i] = 0
+		}
+		return true, nil
+	}
+
+	if _, err := v.r.Seek(v.blockStart(offset), io.SeekStart); err != nil {
+		return false, err
+	}
+
+	if _, err := io.ReadFull(v.r, data); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// blockStart returns the position in the file of the data of the block
+// at offset in the block map
+func (v *vdiImage) blockStart(offset uint32) int64 {
+	return int64(v.header.DataOffset) +
+		int64(offset)*int64(v.header.BlockSize+v.header.BlockExtraSize) +
+		int64(v.header.BlockExtraSize)
+}
+
+// ReadAt reads the virtual disk content at off. Unallocated blocks read
+// as zeros.
+func (v *vdiImage) ReadAt(p []byte, off int64) (int, error) {
+	blockSize := int64(v.header.BlockSize)
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= int64(v.header.DiskSize) {
+			return n, io.EOF
+		}
+
+		within := pos % blockSize
+		chunk := int64(len(p) - n)
+		if chunk > blockSize-within {
+			chunk = blockSize - within
+		}
+		if chunk > int64(v.header.DiskSize)-pos {
+			chunk = int64(v.header.DiskSize) - pos
+		}
+
+		data := p[n : n+int(chunk)]
+		switch offset := v.blockMap[pos/blockSize]; offset {
+		case vdiBlockFree, vdiBlockZero:
+			for i := range data {
+				data[i] = 0
+			}
+		default:
+			if _, err := v.r.Seek(v.blockStart(offset)+within, io.SeekStart); err != nil {
+				return n, err
+			}
+			if _, err := io.ReadFull(v.r, data); err != nil {
+				return n, err
+			}
+		}
+
+		n += len(data)
+	}
+
+	return n, nil
+}
+
+// vdiWriter writes a dynamically allocated VDI image. Blocks are appended
+// in the order they are written.
+type vdiWriter struct {
+	file     *os.File
+	header   vdiHeader
+	blockMap []uint32
+}
+
+func createVDI(location string, size uint64) (*vdiWriter, error) {
+	blocks := (size + vdiBlockSize - 1) / vdiBlockSize
+	blocksOffset := alignUp(vdiPreHeaderSize+vdiHeaderSize, vdiDataAlign)
+
+	w := &vdiWriter{blockMap: make([]uint32, blocks)}
+	for i := range w.blockMap {
+		w.blockMap[i] = vdiBlockFree
+	}
+
+	w.header = vdiHeader{
+		Size:           vdiHeaderSize,
+		Type:           vdiImageTypeNormal,
+		BlocksOffset:   uint32(blocksOffset),
+		DataOffset:     uint32(alignUp(blocksOffset+blocks*4, vdiDataAlign)),
+		SectorSize:     descriptorSectorSize,
+		DiskSize:       blocks * vdiBlockSize,
+		BlockSize:      vdiBlockSize,
+		Blocks:         uint32(blocks),
+		UUIDCreate:     mixedEndianUUID(uuid.New()),
+		UUIDModify:     mixedEndianUUID(uuid.New()),
+		LCHSSectorSize: descriptorSectorSize,
+	}
+
+	file, err := os.OpenFile(location, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+
+	return w, nil
+}
+
+func (w *vdiWriter) blockSize() uint64 {
+	return vdiBlockSize
+}
+
+func (w *vdiWriter) writeBlock(index uint64, data []byte) error {
+	offset := int64(w.header.DataOffset) + int64(w.header.BlocksAllocated)*vdiBlockSize
+	if _, err := w.file.WriteAt(data, offset); err != nil {
+		return err
+	}
+
+	w.blockMap[index] = w.header.BlocksAllocated
+	w.header.BlocksAllocated++
+	return nil
+}
+
+// Close writes the headers and the block map, and closes the file
+func (w *vdiWriter) Close() error {
+	defer w.file.Close()
+
+	preHeader := vdiPreHeader{Signature: vdiSignature, Version: vdiVersion}
+	copy(preHeader.Info[:], vdiInfo)
+
+	dataEnd := int64(w.header.DataOffset) + int64(w.header.BlocksAllocated)*vdiBlockSize
+	if err := w.file.Truncate(dataEnd); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, &preHeader); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, &w.header); err != nil {
+		return err
+	}
+
+	if _, err := w.file.Seek(int64(w.header.BlocksOffset), io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := binary.Write(w.file, binary.LittleEndian, w.blockMap); err != nil {
+		return err
+	}
+
+	return w.file.Close()
+}